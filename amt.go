@@ -26,7 +26,14 @@ type Root struct {
 
 	node *node
 
+	// cid is the CID of the root block this AMT was loaded from or last
+	// flushed to, it's undefined once the AMT is modified.
+	cid cid.Cid
+
 	store cbor.IpldStore
+
+	tracer Tracer
+	trace  *traceCounter
 }
 
 // NewAMT creates a new, empty AMT root with the given IpldStore and options.
@@ -38,10 +45,16 @@ func NewAMT(bs cbor.IpldStore, opts ...Option) (*Root, error) {
 		}
 	}
 
+	if cfg.tracer != nil && cfg.traceCounter == nil {
+		cfg.traceCounter = newTraceCounter()
+	}
+
 	return &Root{
 		bitWidth: cfg.bitWidth,
-		store:    bs,
+		store:    cfg.wrapStore(bs, nil),
 		node:     new(node),
+		tracer:   cfg.tracer,
+		trace:    cfg.traceCounter,
 	}, nil
 }
 
@@ -57,16 +70,60 @@ func LoadAMT(ctx context.Context, bs cbor.IpldStore, c cid.Cid, opts ...Option)
 		}
 	}
 
+	if cfg.tracer != nil && cfg.traceCounter == nil {
+		cfg.traceCounter = newTraceCounter()
+	}
+	bs = cfg.wrapStore(bs, newLoadChecker(cfg))
+
 	var r internal.Root
 	if err := bs.Get(ctx, c, &r); err != nil {
-		return nil, err
+		return nil, withBlock(decodeError(err, "root"), c, -1)
+	}
+
+	if err := checkRoot(&r, cfg); err != nil {
+		return nil, withBlock(err, c, int(r.Height))
+	}
+
+	nd, err := newNode(r.Node, cfg.bitWidth, r.Height == 0, r.Height == 0)
+	if err != nil {
+		return nil, withBlock(err, c, int(r.Height))
+	}
+	if cfg.traceCounter != nil {
+		cfg.traceCounter.root(int(r.Height))
+	}
+
+	return &Root{
+		bitWidth: cfg.bitWidth,
+		height:   int(r.Height),
+		count:    r.Count,
+		node:     nd,
+		cid:      c,
+		store:    bs,
+		tracer:   cfg.tracer,
+		trace:    cfg.traceCounter,
+	}, nil
+}
+
+// checkRoot performs the sanity checks on a serialized root that must pass
+// before its node is expanded.
+func checkRoot(r *internal.Root, cfg *config) error {
+	if err := checkLimit("MaxBitWidth", cfg.maxBitWidth, r.BitWidth); err != nil {
+		return err
+	}
+	if err := checkLimit("MaxHeight", cfg.maxHeight, r.Height); err != nil {
+		return err
+	}
+	for _, v := range r.Node.Values {
+		if err := checkLimit("MaxValueBytes", cfg.maxValueBytes, uint64(len(v.Raw))); err != nil {
+			return err
+		}
 	}
 
 	// Check the bitwidth but don't rely on it. We may add an option in the
 	// future to just discover the bitwidth from the AMT, but we need to be
 	// careful to not just trust the value.
 	if r.BitWidth != uint64(cfg.bitWidth) {
-		return nil, fmt.Errorf("expected bitwidth %d but AMT has bitwidth %d", cfg.bitWidth, r.BitWidth)
+		return fmt.Errorf("%w: expected bitwidth %d but AMT has bitwidth %d", ErrBitWidthMismatch, cfg.bitWidth, r.BitWidth)
 	}
 
 	// Make sure the height is sane to prevent any integer overflows later
@@ -74,7 +131,7 @@ func LoadAMT(ctx context.Context, bs cbor.IpldStore, c cid.Cid, opts ...Option)
 	// might as well use 64 because the height cannot be greater than 62
 	// (min width = 2, 2**64 == max elements).
 	if r.Height > 64 {
-		return nil, fmt.Errorf("height greater than 64: %d", r.Height)
+		return malformedf("height greater than 64: %d", r.Height)
 	}
 
 	maxNodes := nodesForHeight(cfg.bitWidth, int(r.Height+1))
@@ -82,28 +139,14 @@ func LoadAMT(ctx context.Context, bs cbor.IpldStore, c cid.Cid, opts ...Option)
 	// number of nodes at the previous level muss be less. This is the
 	// simplest way to check to see if the height is sane.
 	if maxNodes == math.MaxUint64 && nodesForHeight(cfg.bitWidth, int(r.Height)) == math.MaxUint64 {
-		return nil, fmt.Errorf("failed to load AMT: height %d out of bounds", r.Height)
+		return malformedf("height %d out of bounds", r.Height)
 	}
 
 	// If max nodes is less than the count, something is wrong.
 	if maxNodes < r.Count {
-		return nil, fmt.Errorf(
-			"failed to load AMT: not tall enough (%d) for count (%d)", r.Height, r.Count,
-		)
-	}
-
-	nd, err := newNode(r.Node, cfg.bitWidth, r.Height == 0, r.Height == 0)
-	if err != nil {
-		return nil, err
+		return malformedf("not tall enough (%d) for count (%d)", r.Height, r.Count)
 	}
-
-	return &Root{
-		bitWidth: cfg.bitWidth,
-		height:   int(r.Height),
-		count:    r.Count,
-		node:     nd,
-		store:    bs,
-	}, nil
+	return nil
 }
 
 // FromArray creates a new AMT and performs a BatchSet on it using the vals and
@@ -139,9 +182,12 @@ func FromArray(ctx context.Context, bs cbor.IpldStore, vals []cbg.CBORMarshaler,
 // Set operation for an index between 64 and 511 will require that the AMT have
 // a height of at least 3. Where an AMT has a height less than 3, additional
 // nodes will be added until the height is 3.
-func (r *Root) Set(ctx context.Context, i uint64, val cbg.CBORMarshaler) error {
+func (r *Root) Set(ctx context.Context, i uint64, val cbg.CBORMarshaler) (err error) {
+	ctx, sp := r.startSpan(ctx, "Set")
+	defer func() { r.endSpan(sp, err) }()
+
 	if i > MaxIndex {
-		return fmt.Errorf("index %d is out of range for the amt", i)
+		return indexOutOfRange(i)
 	}
 
 	var d cbg.Deferred
@@ -155,6 +201,17 @@ func (r *Root) Set(ctx context.Context, i uint64, val cbg.CBORMarshaler) error {
 		d.Raw = data
 	}
 
+	return r.setDeferred(ctx, i, &d)
+}
+
+// setDeferred implements Set for a value that is already serialized. The
+// value is stored as-is, so it must not be modified afterwards.
+func (r *Root) setDeferred(ctx context.Context, i uint64, d *cbg.Deferred) error {
+	if i > MaxIndex {
+		return indexOutOfRange(i)
+	}
+	r.cid = cid.Undef
+
 	// where the index is greater than the number of elements we can fit into the
 	// current AMT, grow it until it will fit.
 	for i >= nodesForHeight(r.bitWidth, r.height+1) {
@@ -176,7 +233,7 @@ func (r *Root) Set(ctx context.Context, i uint64, val cbg.CBORMarshaler) error {
 		r.height++
 	}
 
-	addVal, err := r.node.set(ctx, r.store, r.bitWidth, r.height, i, &d)
+	addVal, err := r.node.set(ctx, r.store, r.bitWidth, r.height, i, d)
 	if err != nil {
 		return err
 	}
@@ -184,7 +241,7 @@ func (r *Root) Set(ctx context.Context, i uint64, val cbg.CBORMarshaler) error {
 	if addVal {
 		// Something is wrong, so we'll just do our best to not overflow.
 		if r.count >= (MaxIndex - 1) {
-			return errInvalidCount
+			return malformedf("count does not match number of elements")
 		}
 		r.count++
 	}
@@ -211,9 +268,12 @@ func (r *Root) BatchSet(ctx context.Context, vals []cbg.CBORMarshaler) error {
 // Get retrieves a value from index i.
 // If the index is set, returns true and, if the `out` parameter is not nil,
 // deserializes the value into that interface. Returns false if the index is not set.
-func (r *Root) Get(ctx context.Context, i uint64, out cbg.CBORUnmarshaler) (bool, error) {
+func (r *Root) Get(ctx context.Context, i uint64, out cbg.CBORUnmarshaler) (found bool, err error) {
+	ctx, sp := r.startSpan(ctx, "Get")
+	defer func() { r.endSpan(sp, err) }()
+
 	if i > MaxIndex {
-		return false, fmt.Errorf("index %d is out of range for the amt", i)
+		return false, indexOutOfRange(i)
 	}
 
 	// easy shortcut case, index is too large for our height, don't bother looking
@@ -227,7 +287,7 @@ func (r *Root) Get(ctx context.Context, i uint64, out cbg.CBORUnmarshaler) (bool
 // BatchDelete performs a bulk Delete operation on an array of indices. Each
 // index in the given indices array will be removed from the AMT, if it is present.
 // If `strict` is true, all indices are expected to be present, and this will return an error
-// if one is not found.
+// matching ErrNotFound if one is not found.
 //
 // Returns true if the AMT was modified as a result of this operation.
 //
@@ -249,7 +309,7 @@ func (r *Root) BatchDelete(ctx context.Context, indices []uint64, strict bool) (
 		if err != nil {
 			return false, err
 		} else if strict && !found {
-			return false, fmt.Errorf("no such index %d", i)
+			return false, fmt.Errorf("%w: %d", ErrNotFound, i)
 		}
 		modified = modified || found
 	}
@@ -263,9 +323,12 @@ func (r *Root) BatchDelete(ctx context.Context, indices []uint64, strict bool) (
 // If this delete operation leaves nodes with no remaining elements, the height
 // will be reduced to fit the maximum remaining index, leaving the AMT in
 // canonical form for the given set of data that it contains.
-func (r *Root) Delete(ctx context.Context, i uint64) (bool, error) {
+func (r *Root) Delete(ctx context.Context, i uint64) (found bool, err error) {
+	ctx, sp := r.startSpan(ctx, "Delete")
+	defer func() { r.endSpan(sp, err) }()
+
 	if i > MaxIndex {
-		return false, fmt.Errorf("index %d is out of range for the amt", i)
+		return false, indexOutOfRange(i)
 	}
 
 	// shortcut, index is greater than what we hold so we know it's not there
@@ -273,12 +336,13 @@ func (r *Root) Delete(ctx context.Context, i uint64) (bool, error) {
 		return false, nil
 	}
 
-	found, err := r.node.delete(ctx, r.store, r.bitWidth, r.height, i)
+	found, err = r.node.delete(ctx, r.store, r.bitWidth, r.height, i)
 	if err != nil {
 		return false, err
 	} else if !found {
 		return false, nil
 	}
+	r.cid = cid.Undef
 
 	// The AMT invariant dictates that for any non-empty AMT, the root node must
 	// not address only its left-most child node. Where a deletion has created a
@@ -300,7 +364,7 @@ func (r *Root) Delete(ctx context.Context, i uint64) (bool, error) {
 	// Something is very wrong but there's not much we can do. So we perform
 	// the operation and then tell the user that something is wrong.
 	if r.count == 0 {
-		return false, errInvalidCount
+		return false, malformedf("count does not match number of elements")
 	}
 
 	r.count--
@@ -310,16 +374,36 @@ func (r *Root) Delete(ctx context.Context, i uint64) (bool, error) {
 // ForEach iterates over the entire AMT and calls the cb function for each
 // entry found in the leaf nodes. The callback will receive the index and the
 // value of each element.
-func (r *Root) ForEach(ctx context.Context, cb func(uint64, *cbg.Deferred) error) error {
+func (r *Root) ForEach(ctx context.Context, cb func(uint64, *cbg.Deferred) error) (err error) {
+	ctx, sp := r.startSpan(ctx, "ForEach")
+	defer func() { r.endSpan(sp, err) }()
+
 	return r.node.forEachAt(ctx, r.store, r.bitWidth, r.height, 0, 0, cb)
 }
 
 // ForEachAt iterates over the AMT beginning from the given start index. See
 // ForEach for more details.
-func (r *Root) ForEachAt(ctx context.Context, start uint64, cb func(uint64, *cbg.Deferred) error) error {
+func (r *Root) ForEachAt(ctx context.Context, start uint64, cb func(uint64, *cbg.Deferred) error) (err error) {
+	ctx, sp := r.startSpan(ctx, "ForEachAt")
+	defer func() { r.endSpan(sp, err) }()
+
 	return r.node.forEachAt(ctx, r.store, r.bitWidth, r.height, start, 0, cb)
 }
 
+// ForEachAvailable iterates over the AMT beginning from the given start index
+// like ForEachAt, but where a node isn't found in the store, the subtree below
+// it is skipped rather than failing the iteration. Each such subtree is passed
+// to missing, so that callers holding only part of an AMT can tell which
+// ranges of indexes they are missing values for. Returning an error from
+// missing stops the iteration. Any other error loading a node, such as a
+// malformed block, still fails the iteration.
+func (r *Root) ForEachAvailable(ctx context.Context, start uint64, cb func(uint64, *cbg.Deferred) error, missing func(MissingNode) error) (err error) {
+	ctx, sp := r.startSpan(ctx, "ForEachAvailable")
+	defer func() { r.endSpan(sp, err) }()
+
+	return r.node.forEachAvailable(ctx, r.store, r.bitWidth, r.height, start, 0, cb, missing)
+}
+
 // FirstSetIndex finds the lowest index in this AMT that has a value set for
 // it. If this operation is called on an empty AMT, an ErrNoValues will be
 // returned.
@@ -329,7 +413,10 @@ func (r *Root) FirstSetIndex(ctx context.Context) (uint64, error) {
 
 // Flush saves any unsaved node data and recompacts the in-memory forms of each
 // node where they have been expanded for operational use.
-func (r *Root) Flush(ctx context.Context) (cid.Cid, error) {
+func (r *Root) Flush(ctx context.Context) (_ cid.Cid, err error) {
+	ctx, sp := r.startSpan(ctx, "Flush")
+	defer func() { r.endSpan(sp, err) }()
+
 	nd, err := r.node.flush(ctx, r.store, r.bitWidth, r.height)
 	if err != nil {
 		return cid.Undef, err
@@ -340,7 +427,28 @@ func (r *Root) Flush(ctx context.Context) (cid.Cid, error) {
 		Count:    r.count,
 		Node:     *nd,
 	}
-	return r.store.Put(ctx, &root)
+	c, err := r.store.Put(ctx, &root)
+	if err != nil {
+		return cid.Undef, err
+	}
+	r.cid = c
+	return c, nil
+}
+
+// encode returns the serialized form of the root block, which the AMT must
+// have no unflushed changes for.
+func (r *Root) encode() ([]byte, error) {
+	nd, err := r.node.compact(r.bitWidth, r.height)
+	if err != nil {
+		return nil, err
+	}
+	root := internal.Root{
+		BitWidth: uint64(r.bitWidth),
+		Height:   uint64(r.height),
+		Count:    r.count,
+		Node:     *nd,
+	}
+	return cborToBytes(&root)
 }
 
 // Len returns the "Count" property that is stored in the root of this AMT.
@@ -360,7 +468,11 @@ func (r *Root) Clone() *Root {
 		count:    r.count,
 
 		node: r.node.clone(),
+		cid:  r.cid,
 
 		store: r.store,
+
+		tracer: r.tracer,
+		trace:  r.trace,
 	}
 }
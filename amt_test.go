@@ -12,6 +12,7 @@ import (
 	block "github.com/ipfs/go-block-format"
 	cid "github.com/ipfs/go-cid"
 	cbor "github.com/ipfs/go-ipld-cbor"
+	ipld "github.com/ipfs/go-ipld-format"
 	assert "github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	cbg "github.com/whyrusleeping/cbor-gen"
@@ -70,7 +71,7 @@ func (mb *mockBlocks) Get(_ context.Context, c cid.Cid) (block.Block, error) {
 	if ok {
 		return d, nil
 	}
-	return nil, fmt.Errorf("Not Found")
+	return nil, ipld.ErrNotFound{Cid: c}
 }
 
 func (mb *mockBlocks) Put(_ context.Context, b block.Block) error {
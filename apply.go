@@ -0,0 +1,95 @@
+package amt
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+// Apply performs the given changes, as produced by Diff, on this AMT. Add and
+// Modify changes set their After value and Remove changes delete their index.
+// Values are stored using their raw serialized form, they are not re-marshaled,
+// and are copied so the changes may be modified once Apply returns.
+// Applying Diff(a, b) to a yields an AMT with the same root CID as b.
+//
+// If `strict` is true, the Before value of every change must match the
+// current contents of the AMT (an Add requires the index to be unset) and
+// all changes are checked before any are performed, so a mismatch returns an
+// error without modifying the AMT. If `strict` is false, Add and Modify
+// simply set the index and a Remove of an unset index is ignored.
+func (r *Root) Apply(ctx context.Context, changes []*Change, strict bool) error {
+	for _, ch := range changes {
+		if ch == nil {
+			return fmt.Errorf("cannot apply nil change")
+		}
+		switch ch.Type {
+		case Add, Modify:
+			if ch.After == nil || ch.After.Raw == nil {
+				return fmt.Errorf("change to index %d has no value to set", ch.Key)
+			}
+		case Remove:
+		default:
+			return fmt.Errorf("change to index %d has unknown type %d", ch.Key, ch.Type)
+		}
+	}
+
+	if strict {
+		if err := r.checkChanges(ctx, changes); err != nil {
+			return err
+		}
+	}
+
+	for _, ch := range changes {
+		switch ch.Type {
+		case Add, Modify:
+			// Copy the value so callers may reuse the change afterwards.
+			d := &cbg.Deferred{Raw: append([]byte(nil), ch.After.Raw...)}
+			if err := r.setDeferred(ctx, ch.Key, d); err != nil {
+				return err
+			}
+		case Remove:
+			if _, err := r.Delete(ctx, ch.Key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkChanges verifies that the Before value of each change matches the
+// contents of the AMT at the point that change would be applied, taking into
+// account earlier changes to the same index.
+func (r *Root) checkChanges(ctx context.Context, changes []*Change) error {
+	pending := make(map[uint64]*cbg.Deferred)
+	for _, ch := range changes {
+		current, ok := pending[ch.Key]
+		if !ok {
+			var d cbg.Deferred
+			found, err := r.Get(ctx, ch.Key, &d)
+			if err != nil {
+				return err
+			}
+			if found {
+				current = &d
+			}
+		}
+
+		switch {
+		case ch.Type == Add && current != nil:
+			return fmt.Errorf("cannot add index %d, it is already set", ch.Key)
+		case ch.Type != Add && current == nil:
+			return fmt.Errorf("cannot apply change to index %d, it is not set", ch.Key)
+		case ch.Type != Add && (ch.Before == nil || !bytes.Equal(ch.Before.Raw, current.Raw)):
+			return fmt.Errorf("value at index %d does not match the change", ch.Key)
+		}
+
+		if ch.Type == Remove {
+			pending[ch.Key] = nil
+		} else {
+			pending[ch.Key] = ch.After
+		}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package amt
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/stretchr/testify/require"
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+func TestApplyDiff(t *testing.T) {
+	runTestWithBitWidths(t, bitWidths2to18, func(t *testing.T, opts ...Option) {
+		prevBs := cbor.NewCborStore(newMockBlocks())
+		curBs := cbor.NewCborStore(newMockBlocks())
+		ctx := context.Background()
+
+		a, err := NewAMT(prevBs, opts...)
+		require.NoError(t, err)
+		b, err := NewAMT(curBs, opts...)
+		require.NoError(t, err)
+
+		for i := 0; i < 100; i++ {
+			assertSet(t, a, uint64(i), "foo"+strconv.Itoa(i))
+		}
+		for i := 0; i < 100; i += 2 {
+			assertSet(t, b, uint64(i), "bar"+strconv.Itoa(i))
+		}
+		for i := 2000; i < 2100; i++ {
+			assertSet(t, b, uint64(i), "bar"+strconv.Itoa(i))
+		}
+
+		aCid, err := a.Flush(ctx)
+		require.NoError(t, err)
+		bCid, err := b.Flush(ctx)
+		require.NoError(t, err)
+
+		for _, strict := range []bool{true, false} {
+			changes, err := Diff(ctx, prevBs, curBs, aCid, bCid, opts...)
+			require.NoError(t, err)
+
+			patched, err := LoadAMT(ctx, prevBs, aCid, opts...)
+			require.NoError(t, err)
+			require.NoError(t, patched.Apply(ctx, changes, strict))
+
+			c, err := patched.Flush(ctx)
+			require.NoError(t, err)
+			require.Equal(t, bCid, c)
+			require.Equal(t, b.Len(), patched.Len())
+		}
+
+		// and back again
+		changes, err := Diff(ctx, curBs, prevBs, bCid, aCid, opts...)
+		require.NoError(t, err)
+		patched, err := LoadAMT(ctx, curBs, bCid, opts...)
+		require.NoError(t, err)
+		require.NoError(t, patched.Apply(ctx, changes, true))
+		c, err := patched.Flush(ctx)
+		require.NoError(t, err)
+		require.Equal(t, aCid, c)
+	})
+}
+
+func TestApplyStrictMismatch(t *testing.T) {
+	bs := cbor.NewCborStore(newMockBlocks())
+	ctx := context.Background()
+
+	a, err := NewAMT(bs)
+	require.NoError(t, err)
+	assertSet(t, a, 1, "foo")
+	assertSet(t, a, 100, "bar")
+	before, err := a.Flush(ctx)
+	require.NoError(t, err)
+
+	raw := func(s string) *cbg.Deferred {
+		data, err := cborToBytes(cborstr(s))
+		require.NoError(t, err)
+		return &cbg.Deferred{Raw: data}
+	}
+
+	for name, changes := range map[string][]*Change{
+		"add existing": {
+			{Type: Add, Key: 2, After: raw("baz")},
+			{Type: Add, Key: 1, After: raw("baz")},
+		},
+		"modify wrong value": {
+			{Type: Remove, Key: 100, Before: raw("bar")},
+			{Type: Modify, Key: 1, Before: raw("bar"), After: raw("baz")},
+		},
+		"remove missing": {
+			{Type: Remove, Key: 1, Before: raw("foo")},
+			{Type: Remove, Key: 1, Before: raw("foo")},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			require.Error(t, a.Apply(ctx, changes, true))
+			after, err := a.Flush(ctx)
+			require.NoError(t, err)
+			require.Equal(t, before, after)
+		})
+	}
+
+	// non-strict mode ignores the mismatches
+	require.NoError(t, a.Apply(ctx, []*Change{
+		{Type: Add, Key: 1, After: raw("baz")},
+		{Type: Remove, Key: 5},
+	}, false))
+	assertGet(ctx, t, a, 1, "baz")
+	assertCount(t, a, 2)
+}
+
+func TestApplyCopiesValues(t *testing.T) {
+	bs := cbor.NewCborStore(newMockBlocks())
+	ctx := context.Background()
+
+	a, err := NewAMT(bs)
+	require.NoError(t, err)
+
+	foo, err := cborToBytes(cborstr("foo"))
+	require.NoError(t, err)
+	bar, err := cborToBytes(cborstr("bar"))
+	require.NoError(t, err)
+	require.Equal(t, len(foo), len(bar))
+
+	ch := &Change{Type: Add, Key: 3, After: &cbg.Deferred{Raw: foo}}
+	require.NoError(t, a.Apply(ctx, []*Change{ch}, false))
+
+	// reusing the change must not alter the AMT
+	copy(ch.After.Raw, bar)
+	assertGet(ctx, t, a, 3, "foo")
+}
@@ -0,0 +1,230 @@
+package amt
+
+import (
+	"context"
+
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+// Unreferenced returns the CIDs of the blocks of the AMT at old, including
+// its root block, that the AMT at new doesn't reference, each listed once in
+// the order they are found. opts are applied to both roots.
+//
+// Like Diff, subtrees linked with the same CID from both AMTs are skipped to
+// find the blocks dropped from old. Identical subtrees share a CID though, so
+// a block dropped from one place may still be linked from another part of new.
+// Where any blocks were dropped, the nodes of new are walked to rule those out,
+// visiting each shared block once and stopping as soon as none are left.
+func Unreferenced(ctx context.Context, bs cbor.IpldStore, old, new cid.Cid, opts ...Option) ([]cid.Cid, error) {
+	oldOnly, _, err := diffBlocks(ctx, bs, old, new, opts...)
+	if err != nil || len(oldOnly) == 0 {
+		return nil, err
+	}
+	return excludeReachable(ctx, bs, new, oldOnly, opts...)
+}
+
+// NewBlocks calls cb with each block of the AMT at cur, including its root
+// block, that the AMT at prev doesn't reference, along with the block's
+// serialized form. This is everything a peer holding prev needs to also hold
+// cur. Blocks are found as in Unreferenced, with the nodes of prev walked to
+// rule out blocks it links from elsewhere.
+// The root block comes first and every node follows its parent, so a receiver
+// can check each block against a link it already trusts. opts are applied to
+// both roots.
+func NewBlocks(ctx context.Context, bs cbor.IpldStore, prev, cur cid.Cid, cb func(cid.Cid, []byte) error, opts ...Option) error {
+	cfg := defaultConfig()
+	for _, opt := range opts {
+		if err := opt(cfg); err != nil {
+			return err
+		}
+	}
+
+	_, curOnly, err := diffBlocks(ctx, bs, prev, cur, opts...)
+	if err != nil || len(curOnly) == 0 {
+		return err
+	}
+	if curOnly, err = excludeReachable(ctx, bs, prev, curOnly, opts...); err != nil {
+		return err
+	}
+
+	store := cfg.wrapStore(bs, newLoadChecker(cfg))
+	for _, c := range curOnly {
+		b, err := getRawBlock(ctx, store, c)
+		if err != nil {
+			return err
+		}
+		if err := cb(c, b.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diffBlocks returns the blocks of the AMT at prev that cur doesn't reference
+// and the blocks of cur that prev doesn't reference, each in the order diffAt
+// finds them, in which every node follows its parent.
+func diffBlocks(ctx context.Context, bs cbor.IpldStore, prev, cur cid.Cid, opts ...Option) ([]cid.Cid, []cid.Cid, error) {
+	if prev.Equals(cur) {
+		return nil, nil, nil
+	}
+
+	bc := blockCollector{
+		prev: []cid.Cid{prev},
+		cur:  []cid.Cid{cur},
+	}
+	if err := diff(ctx, bs, bs, prev, cur, &bc, opts...); err != nil {
+		return nil, nil, err
+	}
+
+	prevSet := make(map[cid.Cid]struct{}, len(bc.prev))
+	for _, c := range bc.prev {
+		prevSet[c] = struct{}{}
+	}
+	curSet := make(map[cid.Cid]struct{}, len(bc.cur))
+	for _, c := range bc.cur {
+		curSet[c] = struct{}{}
+	}
+	return exclude(bc.prev, curSet), exclude(bc.cur, prevSet), nil
+}
+
+// exclude returns the CIDs in cids that aren't in set, without duplicates.
+func exclude(cids []cid.Cid, set map[cid.Cid]struct{}) []cid.Cid {
+	var out []cid.Cid
+	seen := make(map[cid.Cid]struct{})
+	for _, c := range cids {
+		if _, ok := set[c]; ok {
+			continue
+		}
+		if _, ok := seen[c]; ok {
+			continue
+		}
+		seen[c] = struct{}{}
+		out = append(out, c)
+	}
+	return out
+}
+
+// excludeReachable returns the CIDs in cids that aren't reachable from the
+// AMT at root.
+func excludeReachable(ctx context.Context, bs cbor.IpldStore, root cid.Cid, cids []cid.Cid, opts ...Option) ([]cid.Cid, error) {
+	pending := make(map[cid.Cid]struct{}, len(cids))
+	for _, c := range cids {
+		pending[c] = struct{}{}
+	}
+	delete(pending, root)
+
+	a, err := LoadAMT(ctx, bs, root, opts...)
+	if err != nil {
+		return nil, err
+	}
+	nc := &nodeContext{bs: a.store, bitWidth: a.bitWidth, height: a.height}
+	if err := markReachable(ctx, nc, a.node, pending, make(map[cid.Cid]struct{})); err != nil {
+		return nil, err
+	}
+
+	var out []cid.Cid
+	for _, c := range cids {
+		if _, ok := pending[c]; ok {
+			out = append(out, c)
+		}
+	}
+	return out, nil
+}
+
+// markReachable removes the CIDs of the nodes below n, a node at nc.height,
+// from pending. Blocks in visited aren't followed again, and nothing more is
+// loaded once pending is empty. Leaves are never loaded.
+func markReachable(ctx context.Context, nc *nodeContext, n *node, pending, visited map[cid.Cid]struct{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if nc.height == 0 {
+		return nil
+	}
+
+	subCtx := nc.child()
+	for _, ln := range n.links {
+		if len(pending) == 0 {
+			return nil
+		}
+		if ln == nil {
+			continue
+		}
+		if _, ok := visited[ln.cid]; ok {
+			continue
+		}
+		visited[ln.cid] = struct{}{}
+		delete(pending, ln.cid)
+		if subCtx.height == 0 {
+			continue
+		}
+
+		sub, err := ln.loadShallow(ctx, subCtx.bs, subCtx.bitWidth, subCtx.height)
+		if err != nil {
+			return err
+		}
+		if err := markReachable(ctx, subCtx, sub, pending, visited); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// blockCollector is a diffVisitor that records the CIDs of the nodes in the
+// differing parts of prev and cur, ignoring values.
+type blockCollector struct {
+	prev, cur []cid.Cid
+}
+
+func (bc *blockCollector) subtree(ctx context.Context, typ ChangeType, nc *nodeContext, ln *link, _ uint64) error {
+	if typ == Add {
+		return collectLinks(ctx, nc, ln, &bc.cur)
+	}
+	return collectLinks(ctx, nc, ln, &bc.prev)
+}
+
+func (bc *blockCollector) nodes(prev, cur *link) error {
+	if prev != nil {
+		bc.prev = append(bc.prev, prev.cid)
+	}
+	if cur != nil {
+		bc.cur = append(bc.cur, cur.cid)
+	}
+	return nil
+}
+
+func (bc *blockCollector) change(ChangeType, uint64, *cbg.Deferred, *cbg.Deferred) error {
+	return nil
+}
+
+// collectLinks appends the CID of the node behind ln, unless it has none, and
+// those of every node below it, each after its parent. Leaves are never
+// loaded.
+func collectLinks(ctx context.Context, nc *nodeContext, ln *link, out *[]cid.Cid) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if ln.cid.Defined() {
+		*out = append(*out, ln.cid)
+	}
+	if nc.height == 0 {
+		return nil
+	}
+
+	n, err := ln.loadShallow(ctx, nc.bs, nc.bitWidth, nc.height)
+	if err != nil {
+		return err
+	}
+	subCtx := nc.child()
+	for _, sub := range n.links {
+		if sub == nil {
+			continue
+		}
+		if err := collectLinks(ctx, subCtx, sub, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
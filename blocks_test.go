@@ -0,0 +1,204 @@
+package amt
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-amt-ipld/v4/internal"
+)
+
+// blockSet returns the CIDs of every block of the AMT at root.
+func blockSet(ctx context.Context, t *testing.T, bs cbor.IpldStore, root cid.Cid, opts ...Option) map[cid.Cid]bool {
+	set := make(map[cid.Cid]bool)
+	require.NoError(t, WalkNodes(ctx, bs, root, func(info NodeInfo) error {
+		set[info.Cid] = true
+		return nil
+	}, opts...))
+	return set
+}
+
+// setDifference returns the CIDs in a that aren't in b.
+func setDifference(a, b map[cid.Cid]bool) map[cid.Cid]bool {
+	out := make(map[cid.Cid]bool)
+	for c := range a {
+		if !b[c] {
+			out[c] = true
+		}
+	}
+	return out
+}
+
+func TestUnreferenced(t *testing.T) {
+	runTestWithBitWidths(t, bitWidths2to18, func(t *testing.T, opts ...Option) {
+		ctx := context.Background()
+		mock := newMockBlocks()
+		bs := cbor.NewCborStore(mock)
+
+		a, err := NewAMT(bs, opts...)
+		require.NoError(t, err)
+		for i := uint64(0); i < 2000; i++ {
+			assertSet(t, a, i, fmt.Sprint(i))
+		}
+		v1, err := a.Flush(ctx)
+		require.NoError(t, err)
+
+		assertSet(t, a, 10, "changed")
+		assertSet(t, a, 1<<30, "far")
+		assertDelete(t, a, 1500)
+		v2, err := a.Flush(ctx)
+		require.NoError(t, err)
+
+		for _, pair := range [][2]cid.Cid{{v1, v2}, {v2, v1}} {
+			old, new := pair[0], pair[1]
+			want := setDifference(blockSet(ctx, t, bs, old, opts...), blockSet(ctx, t, bs, new, opts...))
+
+			mock.getCount = 0
+			got, err := Unreferenced(ctx, bs, old, new, opts...)
+			require.NoError(t, err)
+			require.Len(t, got, len(want))
+			for _, c := range got {
+				require.True(t, want[c], "%s is still referenced", c)
+			}
+			gets := mock.getCount
+			if full := len(blockSet(ctx, t, bs, v1, opts...)); full > 50 {
+				require.Less(t, gets, full/2)
+			}
+		}
+
+		unreferenced, err := Unreferenced(ctx, bs, v2, v2, opts...)
+		require.NoError(t, err)
+		require.Empty(t, unreferenced)
+
+		// emptying the AMT leaves every block of the old one unreferenced
+		for i := uint64(0); i < 2000; i++ {
+			if i != 1500 {
+				assertDelete(t, a, i)
+			}
+		}
+		assertDelete(t, a, 1<<30)
+		empty, err := a.Flush(ctx)
+		require.NoError(t, err)
+		unreferenced, err = Unreferenced(ctx, bs, v2, empty, opts...)
+		require.NoError(t, err)
+		require.Len(t, unreferenced, len(blockSet(ctx, t, bs, v2, opts...)))
+	})
+}
+
+func TestUnreferencedSharedSubtrees(t *testing.T) {
+	ctx := context.Background()
+	bs := cbor.NewCborStore(newMockBlocks())
+	opts := []Option{UseTreeBitWidth(2)}
+
+	// both leaves hold the same values, so they're the same block
+	a, err := NewAMT(bs, opts...)
+	require.NoError(t, err)
+	for i := uint64(0); i < 8; i++ {
+		assertSet(t, a, i, "x")
+	}
+	old, err := a.Flush(ctx)
+	require.NoError(t, err)
+	assertSet(t, a, 0, "y")
+	new, err := a.Flush(ctx)
+	require.NoError(t, err)
+
+	oldBlocks := blockSet(ctx, t, bs, old, opts...)
+	newBlocks := blockSet(ctx, t, bs, new, opts...)
+	require.Len(t, oldBlocks, 2)
+
+	// the shared leaf is still linked from the unchanged slot of new
+	got, err := Unreferenced(ctx, bs, old, new, opts...)
+	require.NoError(t, err)
+	require.Equal(t, []cid.Cid{old}, got)
+	for _, c := range got {
+		require.False(t, newBlocks[c])
+	}
+
+	got, err = Unreferenced(ctx, bs, new, old, opts...)
+	require.NoError(t, err)
+	require.Len(t, got, 2)
+	for _, c := range got {
+		require.True(t, newBlocks[c])
+		require.False(t, oldBlocks[c])
+	}
+}
+
+func TestNewBlocks(t *testing.T) {
+	runTestWithBitWidths(t, bitWidths2to18, func(t *testing.T, opts ...Option) {
+		ctx := context.Background()
+		bs := cbor.NewCborStore(newMockBlocks())
+
+		a, err := NewAMT(bs, opts...)
+		require.NoError(t, err)
+		for i := uint64(0); i < 1000; i++ {
+			assertSet(t, a, i, fmt.Sprint(i))
+		}
+		prev, err := a.Flush(ctx)
+		require.NoError(t, err)
+		assertSet(t, a, 10, "changed")
+		assertSet(t, a, 1<<40, "far")
+		cur, err := a.Flush(ctx)
+		require.NoError(t, err)
+
+		// a peer holding prev
+		peer := newCheckingStore()
+		_, err = Copy(ctx, bs, peer, prev, opts...)
+		require.NoError(t, err)
+
+		want := setDifference(blockSet(ctx, t, bs, cur, opts...), blockSet(ctx, t, bs, prev, opts...))
+		var sent []cid.Cid
+		require.NoError(t, NewBlocks(ctx, bs, prev, cur, func(c cid.Cid, data []byte) error {
+			sent = append(sent, c)
+			require.NoError(t, internal.CheckBlock(c, data))
+			require.NoError(t, putRawBlock(ctx, peer, &rawBlock{cid: c, data: data}))
+			return nil
+		}, opts...))
+		require.Equal(t, cur, sent[0])
+		require.Len(t, sent, len(want))
+
+		b, err := LoadAMT(ctx, peer, cur, opts...)
+		require.NoError(t, err)
+		assertGet(ctx, t, b, 10, "changed")
+		assertGet(ctx, t, b, 1<<40, "far")
+		assertGet(ctx, t, b, 999, "999")
+
+		// nothing is needed to go from a root to itself
+		require.NoError(t, NewBlocks(ctx, bs, cur, cur, func(c cid.Cid, _ []byte) error {
+			t.Fatalf("unexpected block %s", c)
+			return nil
+		}, opts...))
+	})
+}
+
+func TestNewBlocksSharedSubtrees(t *testing.T) {
+	ctx := context.Background()
+	bs := cbor.NewCborStore(newMockBlocks())
+	opts := []Option{UseTreeBitWidth(2)}
+
+	a, err := NewAMT(bs, opts...)
+	require.NoError(t, err)
+	assertSet(t, a, 0, "foo")
+	assertSet(t, a, 20, "bar")
+	prev, err := a.Flush(ctx)
+	require.NoError(t, err)
+
+	// the leaf added at slot 1 is identical to the one prev holds at slot 0
+	assertSet(t, a, 4, "foo")
+	cur, err := a.Flush(ctx)
+	require.NoError(t, err)
+
+	var sent []cid.Cid
+	require.NoError(t, NewBlocks(ctx, bs, prev, cur, func(c cid.Cid, _ []byte) error {
+		sent = append(sent, c)
+		return nil
+	}, opts...))
+	want := setDifference(blockSet(ctx, t, bs, cur, opts...), blockSet(ctx, t, bs, prev, opts...))
+	require.Len(t, sent, len(want))
+	for _, c := range sent {
+		require.True(t, want[c])
+	}
+}
@@ -0,0 +1,76 @@
+package amt
+
+import (
+	"context"
+	"testing"
+
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/stretchr/testify/require"
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+func TestCancel(t *testing.T) {
+	runTestWithBitWidths(t, bitWidths2to18, func(t *testing.T, opts ...Option) {
+		ctx := context.Background()
+		mock := newMockBlocks()
+		bs := cbor.NewCborStore(mock)
+
+		a, err := NewAMT(bs, opts...)
+		require.NoError(t, err)
+		const n = 2_000
+		for i := uint64(0); i < n; i++ {
+			assertSet(t, a, i, "foo")
+		}
+		width := 1 << a.bitWidth
+
+		// Flush stops before writing anything
+		cctx, cancel := context.WithCancel(ctx)
+		cancel()
+		_, err = a.Flush(cctx)
+		require.ErrorIs(t, err, context.Canceled)
+		require.Zero(t, mock.putCount)
+
+		prev, err := a.Flush(ctx)
+		require.NoError(t, err)
+
+		// the tree is now fully cached, so nothing waits on the store, and
+		// ForEach stops at the end of the leaf it was cancelled in, unless that
+		// leaf is the whole tree
+		cctx, cancel = context.WithCancel(ctx)
+		var visited int
+		err = a.ForEach(cctx, func(uint64, *cbg.Deferred) error {
+			visited++
+			cancel()
+			return nil
+		})
+		if a.height > 0 {
+			require.ErrorIs(t, err, context.Canceled)
+			require.LessOrEqual(t, visited, width)
+		} else {
+			require.NoError(t, err)
+			require.Equal(t, n, visited)
+		}
+
+		for i := uint64(0); i < n; i += 2 {
+			assertSet(t, a, i, "bar")
+		}
+		cur, err := a.Flush(ctx)
+		require.NoError(t, err)
+
+		// Diff stops once the roots are loaded
+		cctx, cancel = context.WithCancel(ctx)
+		cancel()
+		mock.getCount = 0
+		_, err = Diff(cctx, bs, bs, prev, cur, opts...)
+		require.ErrorIs(t, err, context.Canceled)
+		require.Equal(t, 2, mock.getCount)
+
+		mock.getCount = 0
+		_, err = ParallelDiff(cctx, bs, bs, prev, cur, 4, opts...)
+		require.ErrorIs(t, err, context.Canceled)
+		require.Equal(t, 2, mock.getCount)
+
+		_, err = DiffKeys(cctx, bs, bs, prev, cur, opts...)
+		require.ErrorIs(t, err, context.Canceled)
+	})
+}
@@ -0,0 +1,83 @@
+package amt
+
+import (
+	"bytes"
+
+	cbg "github.com/whyrusleeping/cbor-gen"
+
+	"github.com/filecoin-project/go-amt-ipld/v4/internal"
+)
+
+// checkCanonicalRoot checks that data is exactly how this library would
+// serialize the root it holds, and that the root's height is no greater than
+// needed. Roots that fail the checks made by LoadAMT are left for it to
+// reject.
+func checkCanonicalRoot(data []byte, bitWidth uint) error {
+	var r internal.Root
+	if err := r.UnmarshalCBOR(bytes.NewReader(data)); err != nil {
+		return err
+	}
+	if r.BitWidth != uint64(bitWidth) || r.Height > 64 {
+		return nil
+	}
+	n, err := newNode(r.Node, bitWidth, r.Height == 0, r.Height == 0)
+	if err != nil {
+		return err
+	}
+
+	// Delete collapses the root until it has a link beyond slot 0.
+	if r.Height > 0 {
+		onlyFirst := true
+		for _, ln := range n.links[1:] {
+			if ln != nil {
+				onlyFirst = false
+				break
+			}
+		}
+		if onlyFirst {
+			return malformedf("non-canonical amt: root at height %d only links to slot 0", r.Height)
+		}
+	}
+
+	nd, err := n.compact(bitWidth, int(r.Height))
+	if err != nil {
+		return err
+	}
+	r.Node = *nd
+	return checkEncoding(data, &r)
+}
+
+// checkCanonicalNode checks that data is exactly how this library would
+// serialize the node it holds.
+func checkCanonicalNode(data []byte, bitWidth uint) error {
+	var nd internal.Node
+	if err := nd.UnmarshalCBOR(bytes.NewReader(data)); err != nil {
+		return err
+	}
+	leaf := len(nd.Values) > 0
+	n, err := newNode(nd, bitWidth, false, leaf)
+	if err != nil {
+		return err
+	}
+	height := 1
+	if leaf {
+		height = 0
+	}
+	compacted, err := n.compact(bitWidth, height)
+	if err != nil {
+		return err
+	}
+	return checkEncoding(data, compacted)
+}
+
+// checkEncoding checks that data is the serialized form of v.
+func checkEncoding(data []byte, v cbg.CBORMarshaler) error {
+	expected, err := cborToBytes(v)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(data, expected) {
+		return malformedf("non-canonical amt: block isn't encoded as this library would encode it")
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package amt
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+	cbg "github.com/whyrusleeping/cbor-gen"
+
+	"github.com/filecoin-project/go-amt-ipld/v4/internal"
+)
+
+// putBytes stores data as a DAG-CBOR block, whatever it holds.
+func putBytes(ctx context.Context, t *testing.T, bs cbor.IpldStore, data []byte) cid.Cid {
+	c, err := cid.Prefix{
+		Version:  1,
+		Codec:    cid.DagCBOR,
+		MhType:   multihash.BLAKE2B_MIN + 31,
+		MhLength: -1,
+	}.Sum(data)
+	require.NoError(t, err)
+	require.NoError(t, putRawBlock(ctx, bs, &rawBlock{cid: c, data: data}))
+	return c
+}
+
+func putEncoded(ctx context.Context, t *testing.T, bs cbor.IpldStore, v cbg.CBORMarshaler) cid.Cid {
+	data, err := cborToBytes(v)
+	require.NoError(t, err)
+	return putBytes(ctx, t, bs, data)
+}
+
+func TestStrictCanonical(t *testing.T) {
+	ctx := context.Background()
+	bs := cbor.NewCborStore(newMockBlocks())
+	value := &cbg.Deferred{Raw: []byte{0x61, 0x61}}
+	strict := []Option{UseTreeBitWidth(1), StrictCanonical()}
+
+	// load succeeds by default but fails with StrictCanonical
+	assertNonCanonical := func(root cid.Cid) {
+		t.Helper()
+		a, err := LoadAMT(ctx, bs, root, UseTreeBitWidth(1))
+		require.NoError(t, err)
+		require.NoError(t, a.ForEach(ctx, func(uint64, *cbg.Deferred) error { return nil }))
+
+		a, err = LoadAMT(ctx, bs, root, strict...)
+		if err == nil {
+			err = a.ForEach(ctx, func(uint64, *cbg.Deferred) error { return nil })
+		}
+		require.ErrorContains(t, err, "non-canonical")
+		require.ErrorContains(t, WalkNodes(ctx, bs, root, func(NodeInfo) error { return nil }, strict...), "non-canonical")
+	}
+
+	leaf := putEncoded(ctx, t, bs, &internal.Node{Bmap: []byte{0x01}, Values: []*cbg.Deferred{value}})
+
+	// a root taller than needed
+	tall := putEncoded(ctx, t, bs, &internal.Root{
+		BitWidth: 1,
+		Height:   1,
+		Count:    1,
+		Node:     internal.Node{Bmap: []byte{0x01}, Links: []cid.Cid{leaf}},
+	})
+	assertNonCanonical(tall)
+
+	// bits set beyond the width of the bitmap
+	garbage := putEncoded(ctx, t, bs, &internal.Node{Bmap: []byte{0x05}, Values: []*cbg.Deferred{value}})
+	root := putEncoded(ctx, t, bs, &internal.Root{
+		BitWidth: 1,
+		Height:   1,
+		Count:    2,
+		Node:     internal.Node{Bmap: []byte{0x03}, Links: []cid.Cid{garbage, leaf}},
+	})
+	assertNonCanonical(root)
+}
+
+func TestStrictCanonicalAcceptsBuiltAMTs(t *testing.T) {
+	runTestWithBitWidths(t, bitWidths2to18, func(t *testing.T, opts ...Option) {
+		ctx := context.Background()
+		bs := cbor.NewCborStore(newMockBlocks())
+
+		a, err := NewAMT(bs, opts...)
+		require.NoError(t, err)
+		for i := uint64(0); i < 500; i += 3 {
+			assertSet(t, a, i, "value")
+		}
+		assertSet(t, a, 1<<40, "far")
+		prev, err := a.Flush(ctx)
+		require.NoError(t, err)
+		assertDelete(t, a, 1<<40)
+		cur, err := a.Flush(ctx)
+		require.NoError(t, err)
+
+		strict := append([]Option{StrictCanonical()}, opts...)
+		b, err := LoadAMT(ctx, bs, cur, strict...)
+		require.NoError(t, err)
+		assertGet(ctx, t, b, 300, "value")
+
+		changes, err := Diff(ctx, bs, bs, prev, cur, strict...)
+		require.NoError(t, err)
+		require.Len(t, changes, 1)
+
+		var buf bytes.Buffer
+		require.NoError(t, ExportCAR(ctx, bs, prev, &buf, strict...))
+	})
+}
@@ -0,0 +1,216 @@
+package amt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	ipld "github.com/ipfs/go-ipld-format"
+	cbg "github.com/whyrusleeping/cbor-gen"
+
+	"github.com/filecoin-project/go-amt-ipld/v4/internal"
+)
+
+// ExportCAR writes the AMT at root to w as a CARv1 stream with root as its
+// only root. The root block comes first, followed by every node in
+// depth-first order, following links in ascending position, so the output for
+// a given AMT is always the same. Blocks are written exactly as they are
+// stored.
+func ExportCAR(ctx context.Context, bs cbor.IpldStore, root cid.Cid, w io.Writer, opts ...Option) error {
+	cfg := defaultConfig()
+	for _, opt := range opts {
+		if err := opt(cfg); err != nil {
+			return err
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	if err := internal.WriteCARHeader(bw, []cid.Cid{root}); err != nil {
+		return err
+	}
+	err := walkRawBlocks(ctx, bs, root, cfg, func(b *rawBlock, _ int, _ uint64, _ *node) error {
+		return internal.WriteCARBlock(bw, b.cid, b.data)
+	})
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// ImportCAR reads a CARv1 stream holding a single AMT, as written by
+// ExportCAR, into bs and returns its root CID. Every block's CID is checked
+// against its bytes. Only the blocks reachable from the root are stored, in
+// any order they appear in the stream, and nothing is stored unless the whole
+// AMT is present and valid.
+func ImportCAR(ctx context.Context, r io.Reader, bs cbor.IpldStore, opts ...Option) (cid.Cid, error) {
+	cfg := defaultConfig()
+	for _, opt := range opts {
+		if err := opt(cfg); err != nil {
+			return cid.Undef, err
+		}
+	}
+
+	br := bufio.NewReader(r)
+	roots, err := internal.ReadCARHeader(br)
+	if err != nil {
+		return cid.Undef, err
+	}
+	if len(roots) != 1 {
+		return cid.Undef, fmt.Errorf("expected CAR with a single root, found %d", len(roots))
+	}
+	root := roots[0]
+
+	blocks := make(carBlocks)
+	for {
+		c, data, err := internal.ReadCARBlock(br)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return cid.Undef, err
+		}
+		if err := internal.CheckBlock(c, data); err != nil {
+			return cid.Undef, err
+		}
+		blocks[c] = data
+	}
+
+	var reachable []*rawBlock
+	err = walkRawBlocks(ctx, blocks, root, cfg, func(b *rawBlock, _ int, _ uint64, _ *node) error {
+		reachable = append(reachable, b)
+		return nil
+	})
+	if err != nil {
+		return cid.Undef, err
+	}
+	bs = cfg.wrapStore(bs, nil)
+	for _, b := range reachable {
+		if err := putRawBlock(ctx, bs, b); err != nil {
+			return cid.Undef, err
+		}
+	}
+	return root, nil
+}
+
+// walkRawBlocks calls cb with the root block of the AMT at root and then each
+// of its node blocks in depth-first order, following links in ascending
+// position. Along with each block, cb receives the height of its node, the
+// index of the node's left-most element and the expanded node. Blocks are
+// checked with the same rules LoadAMT and link.load use.
+func walkRawBlocks(ctx context.Context, bs cbor.IpldStore, root cid.Cid, cfg *config, cb func(b *rawBlock, height int, offset uint64, n *node) error) error {
+	bs = cfg.wrapStore(bs, nil)
+	lc := newLoadChecker(cfg)
+	b, height, nd, err := loadRawRoot(ctx, bs, lc, root)
+	if err != nil {
+		return err
+	}
+	if err := cb(b, height, 0, nd); err != nil {
+		return err
+	}
+	return walkRawNodes(ctx, bs, lc, height, 0, nd, cb)
+}
+
+// loadRawRoot reads and checks the root block of an AMT, returning it with
+// the height and top-most node of the AMT.
+func loadRawRoot(ctx context.Context, bs cbor.IpldStore, lc *loadChecker, root cid.Cid) (*rawBlock, int, *node, error) {
+	b, err := getRawBlock(ctx, bs, root)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	var r internal.Root
+	if err := r.UnmarshalCBOR(bytes.NewReader(b.data)); err != nil {
+		return nil, 0, nil, withBlock(malformedf("decoding root: %w", err), root, -1)
+	}
+	if err := checkRoot(&r, lc.cfg); err != nil {
+		return nil, 0, nil, withBlock(err, root, int(r.Height))
+	}
+	if err := lc.root(b.data); err != nil {
+		return nil, 0, nil, blockError(err, root, int(r.Height))
+	}
+	nd, err := newNode(r.Node, lc.cfg.bitWidth, r.Height == 0, r.Height == 0)
+	if err != nil {
+		return nil, 0, nil, withBlock(err, root, int(r.Height))
+	}
+	return b, int(r.Height), nd, nil
+}
+
+// loadRawNode reads and checks the block c holding a node at the given
+// height below the root.
+func loadRawNode(ctx context.Context, bs cbor.IpldStore, lc *loadChecker, c cid.Cid, height int) (*rawBlock, *node, error) {
+	b, err := getRawBlock(ctx, bs, c)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := lc.node(b.data); err != nil {
+		return nil, nil, blockError(err, b.cid, height)
+	}
+	n, err := decodeNode(b.cid, b.data, lc.cfg.bitWidth, height)
+	if err != nil {
+		return nil, nil, err
+	}
+	return b, n, nil
+}
+
+// decodeNode decodes the serialized node block c and expands it as a node at
+// the given height.
+func decodeNode(c cid.Cid, data []byte, bitWidth uint, height int) (*node, error) {
+	var nd internal.Node
+	if err := nd.UnmarshalCBOR(bytes.NewReader(data)); err != nil {
+		return nil, withBlock(malformedf("decoding node: %w", err), c, height)
+	}
+	n, err := newNode(nd, bitWidth, false, height == 0)
+	if err != nil {
+		return nil, withBlock(err, c, height)
+	}
+	return n, nil
+}
+
+func walkRawNodes(ctx context.Context, bs cbor.IpldStore, lc *loadChecker, height int, offset uint64, n *node, cb func(b *rawBlock, height int, offset uint64, n *node) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if height == 0 {
+		return nil
+	}
+	bitWidth := lc.cfg.bitWidth
+	subCount := nodesForHeight(bitWidth, height)
+	for i, ln := range n.links {
+		if ln == nil {
+			continue
+		}
+		b, subn, err := loadRawNode(ctx, bs, lc, ln.cid, height-1)
+		if err != nil {
+			return err
+		}
+		offs := offset + (uint64(i) * subCount)
+		if err := cb(b, height-1, offs, subn); err != nil {
+			return err
+		}
+		if err := walkRawNodes(ctx, bs, lc, height-1, offs, subn, cb); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// carBlocks holds the blocks read from a CAR, serving them as an IpldStore.
+type carBlocks map[cid.Cid][]byte
+
+func (cb carBlocks) Get(_ context.Context, c cid.Cid, out interface{}) error {
+	data, ok := cb[c]
+	if !ok {
+		return ipld.ErrNotFound{Cid: c}
+	}
+	cu, ok := out.(cbg.CBORUnmarshaler)
+	if !ok {
+		return fmt.Errorf("cannot decode block into %T", out)
+	}
+	return cu.UnmarshalCBOR(bytes.NewReader(data))
+}
+
+func (cb carBlocks) Put(context.Context, interface{}) (cid.Cid, error) {
+	return cid.Undef, fmt.Errorf("CAR blocks are read-only")
+}
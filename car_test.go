@@ -0,0 +1,56 @@
+package amt
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCAR(t *testing.T) {
+	runTestWithBitWidths(t, bitWidths2to18, func(t *testing.T, opts ...Option) {
+		ctx := context.Background()
+		bs := cbor.NewCborStore(newMockBlocks())
+
+		a, err := NewAMT(bs, opts...)
+		require.NoError(t, err)
+		for i := uint64(0); i < 500; i += 7 {
+			assertSet(t, a, i, "value")
+		}
+		assertSet(t, a, 1<<30, "far")
+		c, err := a.Flush(ctx)
+		require.NoError(t, err)
+
+		var buf bytes.Buffer
+		require.NoError(t, ExportCAR(ctx, bs, c, &buf, opts...))
+
+		// exports are deterministic
+		var again bytes.Buffer
+		require.NoError(t, ExportCAR(ctx, bs, c, &again, opts...))
+		require.Equal(t, buf.Bytes(), again.Bytes())
+
+		dst := cbor.NewCborStore(newMockBlocks())
+		imported, err := ImportCAR(ctx, bytes.NewReader(buf.Bytes()), dst, opts...)
+		require.NoError(t, err)
+		require.Equal(t, c, imported)
+
+		b, err := LoadAMT(ctx, dst, imported, opts...)
+		require.NoError(t, err)
+		assertCount(t, b, a.count)
+		assertGet(ctx, t, b, 490, "value")
+		assertGet(ctx, t, b, 1<<30, "far")
+
+		// any modified byte in a block is detected
+		data := buf.Bytes()
+		tampered := append([]byte(nil), data...)
+		tampered[len(tampered)-1] ^= 1
+		_, err = ImportCAR(ctx, bytes.NewReader(tampered), cbor.NewCborStore(newMockBlocks()), opts...)
+		require.Error(t, err)
+
+		// as is a truncated stream
+		_, err = ImportCAR(ctx, bytes.NewReader(data[:len(data)-1]), cbor.NewCborStore(newMockBlocks()), opts...)
+		require.Error(t, err)
+	})
+}
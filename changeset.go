@@ -0,0 +1,282 @@
+package amt
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ipfs/go-cid"
+	cbg "github.com/whyrusleeping/cbor-gen"
+
+	"github.com/filecoin-project/go-amt-ipld/v4/internal"
+)
+
+// String returns the name of the change type: "add", "remove" or "modify".
+func (t ChangeType) String() string {
+	switch t {
+	case Add:
+		return "add"
+	case Remove:
+		return "remove"
+	case Modify:
+		return "modify"
+	default:
+		return fmt.Sprintf("ChangeType(%d)", int(t))
+	}
+}
+
+// MarshalText encodes the change type as its name. Unknown types are encoded
+// as by String, and are rejected by UnmarshalText.
+func (t ChangeType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// UnmarshalText decodes a change type from its name.
+func (t *ChangeType) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "add":
+		*t = Add
+	case "remove":
+		*t = Remove
+	case "modify":
+		*t = Modify
+	default:
+		return fmt.Errorf("unknown change type %q", text)
+	}
+	return nil
+}
+
+// changeJSON is the JSON form of a Change. Values are hex encoded CBOR.
+type changeJSON struct {
+	Type   ChangeType `json:"type"`
+	Key    uint64     `json:"key"`
+	Before *string    `json:"before"`
+	After  *string    `json:"after"`
+}
+
+// MarshalJSON encodes the change as a JSON object with a named type and hex
+// encoded CBOR values, e.g.
+//
+//	{"type":"modify","key":5,"before":"63666f6f","after":"63626172"}
+//
+// Values are encoded where present, whether or not the type requires them, so
+// that any change can be printed. UnmarshalJSON rejects changes that don't
+// have exactly the values their type requires.
+func (ch Change) MarshalJSON() ([]byte, error) {
+	encode := func(v *cbg.Deferred) *string {
+		if v == nil || v.Raw == nil {
+			return nil
+		}
+		s := hex.EncodeToString(v.Raw)
+		return &s
+	}
+	return json.Marshal(changeJSON{
+		Type:   ch.Type,
+		Key:    ch.Key,
+		Before: encode(ch.Before),
+		After:  encode(ch.After),
+	})
+}
+
+// UnmarshalJSON decodes a change in the form produced by MarshalJSON.
+func (ch *Change) UnmarshalJSON(b []byte) error {
+	var cj changeJSON
+	if err := json.Unmarshal(b, &cj); err != nil {
+		return err
+	}
+	decode := func(s *string) (*cbg.Deferred, error) {
+		if s == nil {
+			return nil, nil
+		}
+		raw, err := hex.DecodeString(*s)
+		if err != nil {
+			return nil, err
+		}
+		return &cbg.Deferred{Raw: raw}, nil
+	}
+	before, err := decode(cj.Before)
+	if err != nil {
+		return fmt.Errorf("decoding before value of index %d: %w", cj.Key, err)
+	}
+	after, err := decode(cj.After)
+	if err != nil {
+		return fmt.Errorf("decoding after value of index %d: %w", cj.Key, err)
+	}
+	out := Change{Type: cj.Type, Key: cj.Key, Before: before, After: after}
+	if err := checkChange(&out); err != nil {
+		return err
+	}
+	*ch = out
+	return nil
+}
+
+// checkChange ensures a change has exactly the values its type requires.
+func checkChange(ch *Change) error {
+	hasBefore := ch.Before != nil && ch.Before.Raw != nil
+	hasAfter := ch.After != nil && ch.After.Raw != nil
+	switch ch.Type {
+	case Add:
+		if hasBefore || !hasAfter {
+			return fmt.Errorf("add of index %d must have only an after value", ch.Key)
+		}
+	case Remove:
+		if !hasBefore || hasAfter {
+			return fmt.Errorf("remove of index %d must have only a before value", ch.Key)
+		}
+	case Modify:
+		if !hasBefore || !hasAfter {
+			return fmt.Errorf("modify of index %d must have before and after values", ch.Key)
+		}
+	default:
+		return fmt.Errorf("change to index %d has unknown type %d", ch.Key, int(ch.Type))
+	}
+	return nil
+}
+
+// ChangeSet is the set of changes that transform the AMT at Prev into the AMT
+// at Cur, as produced by Diff.
+//
+// A ChangeSet has a JSON form, using the JSON form of Change, and a binary
+// form written by EncodeChangeSet. The binary form is a CBOR sequence of a
+// header holding Prev and Cur followed by one element per change, see
+// internal.ChangeSetHeader and internal.Change. ChangeSetWriter and
+// ChangeSetReader produce and consume the same form one change at a time.
+type ChangeSet struct {
+	Prev    cid.Cid   `json:"prev"`
+	Cur     cid.Cid   `json:"cur"`
+	Changes []*Change `json:"changes"`
+}
+
+// EncodeChangeSet writes the binary form of cs to w.
+func EncodeChangeSet(w io.Writer, cs *ChangeSet) error {
+	csw, err := NewChangeSetWriter(w, cs.Prev, cs.Cur)
+	if err != nil {
+		return err
+	}
+	for _, ch := range cs.Changes {
+		if err := csw.Write(ch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DecodeChangeSet reads the binary form of a change set from r, until r is
+// exhausted.
+func DecodeChangeSet(r io.Reader) (*ChangeSet, error) {
+	csr, err := NewChangeSetReader(r)
+	if err != nil {
+		return nil, err
+	}
+	cs := &ChangeSet{Prev: csr.Prev(), Cur: csr.Cur()}
+	for {
+		ch, err := csr.Next()
+		if err == io.EOF {
+			return cs, nil
+		} else if err != nil {
+			return nil, err
+		}
+		cs.Changes = append(cs.Changes, ch)
+	}
+}
+
+// ChangeSetWriter streams the binary form of a change set to an io.Writer, so
+// that large change sets don't need to be held in memory.
+type ChangeSetWriter struct {
+	w io.Writer
+}
+
+// NewChangeSetWriter writes the header of a change set from prev to cur to w
+// and returns a writer for its changes.
+func NewChangeSetWriter(w io.Writer, prev, cur cid.Cid) (*ChangeSetWriter, error) {
+	hdr := internal.ChangeSetHeader{Prev: prev, Cur: cur}
+	if err := hdr.MarshalCBOR(w); err != nil {
+		return nil, fmt.Errorf("writing change set header: %w", err)
+	}
+	return &ChangeSetWriter{w: w}, nil
+}
+
+// Write appends a single change to the change set.
+func (csw *ChangeSetWriter) Write(ch *Change) error {
+	if err := checkChange(ch); err != nil {
+		return err
+	}
+	ich := internal.Change{
+		Type: uint64(ch.Type),
+		Key:  ch.Key,
+		// Marshaled as null where not required by the type.
+		Before: ch.Before,
+		After:  ch.After,
+	}
+	return ich.MarshalCBOR(csw.w)
+}
+
+// ChangeSetReader streams changes from the binary form of a change set.
+type ChangeSetReader struct {
+	cr        *cbg.CborReader
+	prev, cur cid.Cid
+}
+
+// NewChangeSetReader reads the header of a change set from r and returns a
+// reader for its changes.
+func NewChangeSetReader(r io.Reader) (*ChangeSetReader, error) {
+	if _, ok := r.(io.ByteScanner); !ok {
+		r = bufio.NewReader(r)
+	}
+	cr := cbg.NewCborReader(r)
+
+	var hdr internal.ChangeSetHeader
+	if err := hdr.UnmarshalCBOR(cr); err != nil {
+		return nil, fmt.Errorf("reading change set header: %w", err)
+	}
+	return &ChangeSetReader{cr: cr, prev: hdr.Prev, cur: hdr.Cur}, nil
+}
+
+// Prev returns the root CID the change set applies to.
+func (csr *ChangeSetReader) Prev() cid.Cid {
+	return csr.prev
+}
+
+// Cur returns the root CID the change set results in.
+func (csr *ChangeSetReader) Cur() cid.Cid {
+	return csr.cur
+}
+
+// Next returns the next change in the change set, or io.EOF once all changes
+// have been read.
+func (csr *ChangeSetReader) Next() (*Change, error) {
+	var ich internal.Change
+	if err := ich.UnmarshalCBOR(csr.cr); err == io.EOF {
+		return nil, io.EOF
+	} else if errors.Is(err, io.EOF) {
+		// EOF part way through a change.
+		return nil, fmt.Errorf("reading change: %w", io.ErrUnexpectedEOF)
+	} else if err != nil {
+		return nil, err
+	}
+
+	if ich.Type > uint64(Modify) {
+		return nil, fmt.Errorf("change to index %d has unknown type %d", ich.Key, ich.Type)
+	}
+	ch := &Change{
+		Type:   ChangeType(ich.Type),
+		Key:    ich.Key,
+		Before: ich.Before,
+		After:  ich.After,
+	}
+	// A null value is decoded as a Deferred holding null, which is also a valid
+	// value, so the type decides which values are present.
+	switch ch.Type {
+	case Add:
+		ch.Before = nil
+	case Remove:
+		ch.After = nil
+	}
+	if err := checkChange(ch); err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
@@ -0,0 +1,113 @@
+package amt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"strconv"
+	"testing"
+
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/stretchr/testify/require"
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+func TestChangeTypeString(t *testing.T) {
+	require.Equal(t, "add", Add.String())
+	require.Equal(t, "remove", Remove.String())
+	require.Equal(t, "modify", Modify.String())
+	require.Equal(t, "ChangeType(7)", ChangeType(7).String())
+
+	ch := Change{Type: Remove, Key: 3, Before: &cbg.Deferred{Raw: cbg.CborNull}}
+	require.Equal(t, `{"type":"remove","key":3,"before":"f6","after":null}`, ch.String())
+
+	// Changes that couldn't be decoded are still printed.
+	require.Equal(t, `{"type":"add","key":1,"before":null,"after":null}`, Change{Type: Add, Key: 1}.String())
+	ch = Change{Type: ChangeType(7), Key: 2, After: &cbg.Deferred{Raw: cbg.CborNull}}
+	require.Equal(t, `{"type":"ChangeType(7)","key":2,"before":null,"after":"f6"}`, ch.String())
+	require.Error(t, json.Unmarshal([]byte(ch.String()), new(Change)))
+}
+
+func TestChangeSetRoundTrip(t *testing.T) {
+	prevBs := cbor.NewCborStore(newMockBlocks())
+	curBs := cbor.NewCborStore(newMockBlocks())
+	ctx := context.Background()
+
+	a, err := NewAMT(prevBs)
+	require.NoError(t, err)
+	b, err := NewAMT(curBs)
+	require.NoError(t, err)
+
+	for i := 0; i < 10000; i++ {
+		assertSet(t, a, uint64(i), "foo"+strconv.Itoa(i))
+	}
+	for i := 0; i < 10000; i += 3 {
+		assertSet(t, b, uint64(i), "bar"+strconv.Itoa(i))
+	}
+	// a null value must survive the round trip
+	require.NoError(t, b.Set(ctx, 20000, nil))
+
+	aCid, err := a.Flush(ctx)
+	require.NoError(t, err)
+	bCid, err := b.Flush(ctx)
+	require.NoError(t, err)
+
+	changes, err := Diff(ctx, prevBs, curBs, aCid, bCid)
+	require.NoError(t, err)
+	require.Greater(t, len(changes), 8192)
+	cs := &ChangeSet{Prev: aCid, Cur: bCid, Changes: changes}
+
+	t.Run("cbor", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, EncodeChangeSet(&buf, cs))
+		decoded, err := DecodeChangeSet(&buf)
+		require.NoError(t, err)
+		require.Equal(t, cs, decoded)
+	})
+
+	t.Run("json", func(t *testing.T) {
+		data, err := json.Marshal(cs)
+		require.NoError(t, err)
+		var decoded ChangeSet
+		require.NoError(t, json.Unmarshal(data, &decoded))
+		require.Equal(t, cs, &decoded)
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		var buf bytes.Buffer
+		w, err := NewChangeSetWriter(&buf, aCid, bCid)
+		require.NoError(t, err)
+		for _, ch := range changes {
+			require.NoError(t, w.Write(ch))
+		}
+
+		r, err := NewChangeSetReader(&buf)
+		require.NoError(t, err)
+		require.Equal(t, aCid, r.Prev())
+		require.Equal(t, bCid, r.Cur())
+
+		patched, err := LoadAMT(ctx, prevBs, r.Prev())
+		require.NoError(t, err)
+		var read []*Change
+		for {
+			ch, err := r.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			read = append(read, ch)
+		}
+		require.NoError(t, patched.Apply(ctx, read, true))
+		c, err := patched.Flush(ctx)
+		require.NoError(t, err)
+		require.Equal(t, r.Cur(), c)
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, EncodeChangeSet(&buf, cs))
+		_, err := DecodeChangeSet(bytes.NewReader(buf.Bytes()[:buf.Len()-1]))
+		require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	})
+}
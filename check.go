@@ -0,0 +1,108 @@
+package amt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/filecoin-project/go-amt-ipld/v4/internal"
+)
+
+// ErrLimitExceeded is matched by every LimitError, so errors.Is can be used
+// to tell whether an AMT was rejected for exceeding a limit.
+var ErrLimitExceeded = errors.New("amt limit exceeded")
+
+// LimitError is returned where an AMT being read exceeds a limit set with
+// MaxBitWidth, MaxHeight, MaxNodeBytes, MaxValueBytes or MaxNodesLoaded.
+type LimitError struct {
+	// Limit is the name of the Option setting the limit, e.g. "MaxHeight".
+	Limit string
+	// Max is the limit and Actual the value found to exceed it. For
+	// MaxNodesLoaded, Actual is the count at which loading was stopped.
+	Max, Actual uint64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("amt exceeds %s: %d > %d", e.Limit, e.Actual, e.Max)
+}
+
+func (e *LimitError) Is(target error) bool {
+	return target == ErrLimitExceeded
+}
+
+// checkLimit returns a LimitError where actual is greater than max.
+func checkLimit(limit string, max, actual uint64) error {
+	if actual > max {
+		return &LimitError{Limit: limit, Max: max, Actual: actual}
+	}
+	return nil
+}
+
+// loadChecker applies the load-time checks set in a config, such as
+// StrictCanonical, to the serialized blocks of a single AMT as they are read.
+type loadChecker struct {
+	cfg    *config
+	loaded atomic.Uint64
+}
+
+func newLoadChecker(cfg *config) *loadChecker {
+	return &loadChecker{cfg: cfg}
+}
+
+// enabled reports whether there's anything to check.
+func (lc *loadChecker) enabled() bool {
+	return lc.cfg.strictCanonical || lc.cfg.limited
+}
+
+// block counts a root or node block of the given size being read, and checks
+// it against MaxNodesLoaded and MaxNodeBytes.
+func (lc *loadChecker) block(data []byte) error {
+	if !lc.cfg.limited {
+		return nil
+	}
+	if err := checkLimit("MaxNodesLoaded", lc.cfg.maxNodesLoaded, lc.loaded.Add(1)); err != nil {
+		return err
+	}
+	return checkLimit("MaxNodeBytes", lc.cfg.maxNodeBytes, uint64(len(data)))
+}
+
+// root checks a serialized root. Its bit width, height and values are checked
+// by checkRoot once it's decoded.
+func (lc *loadChecker) root(data []byte) error {
+	if err := lc.block(data); err != nil {
+		return err
+	}
+	if lc.cfg.strictCanonical {
+		return checkCanonicalRoot(data, lc.cfg.bitWidth)
+	}
+	return nil
+}
+
+// node checks a serialized node.
+func (lc *loadChecker) node(data []byte) error {
+	if err := lc.block(data); err != nil {
+		return err
+	}
+	return lc.nodeContents(data)
+}
+
+// nodeContents applies the checks of node that look inside the block, for a
+// node that block has already been applied to.
+func (lc *loadChecker) nodeContents(data []byte) error {
+	if lc.cfg.maxValueBytes != noLimit {
+		var sn internal.ShallowNode
+		if err := sn.UnmarshalCBOR(bytes.NewReader(data)); err != nil {
+			return err
+		}
+		for _, size := range sn.ValueSizes {
+			if err := checkLimit("MaxValueBytes", lc.cfg.maxValueBytes, uint64(size)); err != nil {
+				return err
+			}
+		}
+	}
+	if lc.cfg.strictCanonical {
+		return checkCanonicalNode(data, lc.cfg.bitWidth)
+	}
+	return nil
+}
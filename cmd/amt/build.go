@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/multiformats/go-multihash"
+	cbg "github.com/whyrusleeping/cbor-gen"
+
+	amt "github.com/filecoin-project/go-amt-ipld/v4"
+)
+
+// runBuild builds an AMT from a file of index and value pairs, writes it to a
+// CAR file and prints its root. The result only depends on the pairs, not
+// their order.
+func runBuild(ctx context.Context, args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("build", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	input := fs.String("input", "jsonl", "input format: jsonl, one {\"index\":N,\"value\":V} object per line, or cbor, a CBOR sequence of [index, value] arrays")
+	values := fs.String("values", "dag-json", "format of jsonl values: dag-json, or hex for hex encoded CBOR strings")
+	bitWidth := fs.Uint("bitwidth", 3, "bitwidth of the AMT")
+	hash := fs.String("hash", "blake2b-256", "multihash function for the AMT's blocks")
+	out := fs.String("out", "", "CAR file to write the AMT to")
+
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(positional) != 1 || *out == "" {
+		return errors.New("usage: amt build [flags] --out <car> <input>")
+	}
+	mhType, ok := multihash.Names[*hash]
+	if !ok {
+		return fmt.Errorf("unknown hash function %q", *hash)
+	}
+
+	var r io.Reader = os.Stdin
+	if positional[0] != "-" {
+		f, err := os.Open(positional[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close() //nolint:errcheck
+		r = f
+	}
+
+	var pairs map[uint64]*cbg.Deferred
+	var err error
+	switch *input {
+	case "jsonl":
+		pairs, err = readJSONLines(r, *values)
+	case "cbor":
+		pairs, err = readCBORPairs(r)
+	default:
+		return fmt.Errorf("unknown input format %q, expected jsonl or cbor", *input)
+	}
+	if err != nil {
+		return err
+	}
+
+	bs := &blockstore{blocks: make(map[cid.Cid][]byte)}
+	store := cbor.NewCborStore(bs)
+	store.DefaultMultihash = mhType
+	opts := []amt.Option{amt.UseTreeBitWidth(*bitWidth)}
+	root, err := buildAMT(ctx, store, pairs, opts...)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	if err := amt.ExportCAR(ctx, store, root, f, opts...); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(stdout, root)
+	return err
+}
+
+// buildAMT builds an AMT holding pairs. Where the indexes are exactly
+// 0 to len(pairs)-1 the AMT is built with FromArray, otherwise by setting each
+// value in index order.
+func buildAMT(ctx context.Context, store cbor.IpldStore, pairs map[uint64]*cbg.Deferred, opts ...amt.Option) (cid.Cid, error) {
+	indexes := make([]uint64, 0, len(pairs))
+	for i := range pairs {
+		indexes = append(indexes, i)
+	}
+	sort.Slice(indexes, func(a, b int) bool { return indexes[a] < indexes[b] })
+
+	if len(indexes) == 0 || indexes[len(indexes)-1] == uint64(len(indexes)-1) {
+		vals := make([]cbg.CBORMarshaler, len(indexes))
+		for _, i := range indexes {
+			vals[i] = pairs[i]
+		}
+		return amt.FromArray(ctx, store, vals, opts...)
+	}
+
+	a, err := amt.NewAMT(store, opts...)
+	if err != nil {
+		return cid.Undef, err
+	}
+	for _, i := range indexes {
+		if err := a.Set(ctx, i, pairs[i]); err != nil {
+			return cid.Undef, err
+		}
+	}
+	return a.Flush(ctx)
+}
+
+// addPair records a value, rejecting an index given twice as the result
+// would depend on the order of the input.
+func addPair(pairs map[uint64]*cbg.Deferred, i uint64, v *cbg.Deferred) error {
+	if i > amt.MaxIndex {
+		return fmt.Errorf("index %d is out of range", i)
+	}
+	if _, ok := pairs[i]; ok {
+		return fmt.Errorf("index %d is given more than once", i)
+	}
+	pairs[i] = v
+	return nil
+}
+
+func readJSONLines(r io.Reader, values string) (map[uint64]*cbg.Deferred, error) {
+	if values != "dag-json" && values != "hex" {
+		return nil, fmt.Errorf("unknown value format %q, expected dag-json or hex", values)
+	}
+
+	pairs := make(map[uint64]*cbg.Deferred)
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 64<<20)
+	for line := 1; sc.Scan(); line++ {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		var entry map[string]json.RawMessage
+		if err := json.Unmarshal(sc.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		index, value := entry["index"], entry["value"]
+		if index == nil || value == nil || len(entry) != 2 {
+			return nil, fmt.Errorf("line %d: expected an index and a value", line)
+		}
+		i, err := strconv.ParseUint(string(index), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid index %s", line, index)
+		}
+
+		var raw []byte
+		if values == "hex" {
+			var s string
+			if err := json.Unmarshal(value, &s); err != nil {
+				return nil, fmt.Errorf("line %d: value should be a hex string", line)
+			}
+			if raw, err = hex.DecodeString(s); err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+		} else if raw, err = dagJSONToCBOR(value); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		// check the value is a single CBOR item
+		var v cbg.Deferred
+		if err := v.UnmarshalCBOR(bytes.NewReader(raw)); err != nil || len(v.Raw) != len(raw) {
+			return nil, fmt.Errorf("line %d: value is not a single CBOR item", line)
+		}
+		if err := addPair(pairs, i, &v); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return pairs, nil
+}
+
+func readCBORPairs(r io.Reader) (map[uint64]*cbg.Deferred, error) {
+	pairs := make(map[uint64]*cbg.Deferred)
+	cr := cbg.NewCborReader(bufio.NewReader(r))
+	for n := 0; ; n++ {
+		maj, extra, err := cr.ReadHeader()
+		if err == io.EOF {
+			return pairs, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("pair %d: %w", n, err)
+		}
+		if maj != cbg.MajArray || extra != 2 {
+			return nil, fmt.Errorf("pair %d: expected an array of an index and a value", n)
+		}
+		maj, i, err := cr.ReadHeader()
+		if err != nil {
+			return nil, fmt.Errorf("pair %d: %w", n, err)
+		}
+		if maj != cbg.MajUnsignedInt {
+			return nil, fmt.Errorf("pair %d: index should be an unsigned integer", n)
+		}
+		var v cbg.Deferred
+		if err := v.UnmarshalCBOR(cr); err != nil {
+			return nil, fmt.Errorf("pair %d: %w", n, err)
+		}
+		if err := addPair(pairs, i, &v); err != nil {
+			return nil, fmt.Errorf("pair %d: %w", n, err)
+		}
+	}
+}
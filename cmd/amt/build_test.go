@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+func TestBuild(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+		return path
+	}
+	build := func(input string, flags ...string) (cid.Cid, []byte) {
+		car := filepath.Join(dir, "out.car")
+		out, err := runCommand(t, append([]string{"build", "--out", car, input}, flags...)...)
+		require.NoError(t, err)
+		root, err := cid.Decode(strings.TrimSpace(out))
+		require.NoError(t, err)
+		data, err := os.ReadFile(car)
+		require.NoError(t, err)
+		return root, data
+	}
+
+	sparse := write("sparse.jsonl", strings.Join([]string{
+		`{"index": 1000, "value": {"b": [1, -2, 1.5], "a": {"/": {"bytes": "AQI"}}}}`,
+		`{"index": 3, "value": "three"}`,
+		``,
+		`{"index": 70000, "value": null}`,
+	}, "\n"))
+	shuffled := write("shuffled.jsonl", strings.Join([]string{
+		`{"index": 70000, "value": null}`,
+		`{"index": 3, "value": "three"}`,
+		`{"index": 1000, "value": {"a": {"/": {"bytes": "AQI"}}, "b": [1, -2, 1.5]}}`,
+	}, "\n"))
+	root, data := build(sparse)
+	root2, data2 := build(shuffled)
+	require.Equal(t, root, root2)
+	require.Equal(t, data, data2)
+
+	car := filepath.Join(dir, "out.car")
+	out, err := runCommand(t, "ls", root.String(), "--car", car, "--output=diag")
+	require.NoError(t, err)
+	require.Equal(t, strings.Join([]string{
+		`{"index": 3, "value": "three"}`,
+		`{"index": 1000, "value": {"a": h'0102', "b": [1, -2, 1.5]}}`,
+		`{"index": 70000, "value": null}`,
+	}, "\n")+"\n", out)
+
+	// dense input is built with FromArray, giving the same AMT as Set would
+	dense := write("dense.jsonl", `{"index":1,"value":"626162"}`+"\n"+`{"index":0,"value":"f5"}`)
+	denseRoot, _ := build(dense, "--values=hex", "--bitwidth=5")
+
+	var seq bytes.Buffer
+	cw := cbg.NewCborWriter(&seq)
+	for i, v := range [][]byte{{0xf5}, {0x62, 0x61, 0x62}} {
+		require.NoError(t, cw.WriteMajorTypeHeader(cbg.MajArray, 2))
+		require.NoError(t, cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(i)))
+		_, err := cw.Write(v)
+		require.NoError(t, err)
+	}
+	cborRoot, _ := build(write("dense.cbor", seq.String()), "--input=cbor", "--bitwidth=5")
+	require.Equal(t, denseRoot, cborRoot)
+
+	out, err = runCommand(t, "get", denseRoot.String(), "1", "--car", car)
+	require.NoError(t, err)
+	require.Equal(t, `{"index":1,"value":"626162"}`+"\n", out)
+
+	shaRoot, _ := build(sparse, "--hash=sha2-256")
+	require.Equal(t, uint64(multihash.SHA2_256), shaRoot.Prefix().MhType)
+	out, err = runCommand(t, "validate", shaRoot.String(), "--car", car)
+	require.NoError(t, err)
+	require.Contains(t, out, `"count":3`)
+
+	for _, bad := range []string{
+		`{"index": 1, "value": 1}` + "\n" + `{"index": 1, "value": 2}`,
+		`{"index": -1, "value": 1}`,
+		`{"index": 1}`,
+		`{"index": 1, "value": {"/": "not a cid"}}`,
+	} {
+		_, err := runCommand(t, "build", "--out", car, write("bad.jsonl", bad))
+		require.Error(t, err, bad)
+	}
+	_, err = runCommand(t, "build", "--out", car, "--values=hex", write("bad.jsonl", `{"index": 1, "value": "0102"}`))
+	require.Error(t, err)
+}
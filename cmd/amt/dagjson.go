@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/ipfs/go-cid"
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+// maxDAGJSONDepth limits the nesting of values dagJSONToCBOR will convert.
+const maxDAGJSONDepth = 64
+
+// dagJSONToCBOR converts a DAG-JSON value to DAG-CBOR. Links ({"/": cid}) and
+// bytes ({"/": {"bytes": base64}}) are converted to their DAG-CBOR forms, map
+// keys are sorted as DAG-CBOR requires, and numbers that aren't integers are
+// encoded as 64-bit floats.
+func dagJSONToCBOR(data json.RawMessage) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := writeDAGJSON(cbg.NewCborWriter(&buf), v, 0); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeDAGJSON(cw *cbg.CborWriter, v any, depth int) error {
+	if depth > maxDAGJSONDepth {
+		return fmt.Errorf("value nested deeper than %d", maxDAGJSONDepth)
+	}
+	switch v := v.(type) {
+	case nil:
+		_, err := cw.Write(cbg.CborNull)
+		return err
+	case bool:
+		if v {
+			_, err := cw.Write(cbg.CborBoolTrue)
+			return err
+		}
+		_, err := cw.Write(cbg.CborBoolFalse)
+		return err
+	case json.Number:
+		return writeNumber(cw, v)
+	case string:
+		if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len(v))); err != nil {
+			return err
+		}
+		_, err := cw.WriteString(v)
+		return err
+	case []any:
+		if err := cw.WriteMajorTypeHeader(cbg.MajArray, uint64(len(v))); err != nil {
+			return err
+		}
+		for _, item := range v {
+			if err := writeDAGJSON(cw, item, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	case map[string]any:
+		if special, ok := v["/"]; ok && len(v) == 1 {
+			return writeDAGJSONSpecial(cw, special)
+		}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		// DAG-CBOR orders keys by length, then bytewise
+		sort.Slice(keys, func(i, j int) bool {
+			if len(keys[i]) != len(keys[j]) {
+				return len(keys[i]) < len(keys[j])
+			}
+			return keys[i] < keys[j]
+		})
+		if err := cw.WriteMajorTypeHeader(cbg.MajMap, uint64(len(keys))); err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := writeDAGJSON(cw, k, depth+1); err != nil {
+				return err
+			}
+			if err := writeDAGJSON(cw, v[k], depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unexpected JSON value %T", v)
+	}
+}
+
+// writeDAGJSONSpecial writes the value of a map whose only key is "/", which
+// is either a link or bytes.
+func writeDAGJSONSpecial(cw *cbg.CborWriter, v any) error {
+	switch v := v.(type) {
+	case string:
+		c, err := cid.Decode(v)
+		if err != nil {
+			return fmt.Errorf("invalid link %q: %w", v, err)
+		}
+		return cbg.WriteCid(cw, c)
+	case map[string]any:
+		s, ok := v["bytes"].(string)
+		if !ok || len(v) != 1 {
+			return fmt.Errorf("invalid DAG-JSON bytes")
+		}
+		b, err := base64.RawStdEncoding.DecodeString(s)
+		if err != nil {
+			return fmt.Errorf("invalid DAG-JSON bytes: %w", err)
+		}
+		if err := cw.WriteMajorTypeHeader(cbg.MajByteString, uint64(len(b))); err != nil {
+			return err
+		}
+		_, err = cw.Write(b)
+		return err
+	default:
+		return fmt.Errorf("invalid DAG-JSON value for key \"/\"")
+	}
+}
+
+func writeNumber(cw *cbg.CborWriter, n json.Number) error {
+	s := n.String()
+	if u, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, u)
+	}
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return cw.WriteMajorTypeHeader(cbg.MajNegativeInt, uint64(-(i + 1)))
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return fmt.Errorf("invalid number %s: %w", s, err)
+	}
+	var b [9]byte
+	b[0] = 0xfb
+	bits := math.Float64bits(f)
+	for i := 0; i < 8; i++ {
+		b[8-i] = byte(bits >> (8 * i))
+	}
+	_, err = cw.Write(b[:])
+	return err
+}
@@ -0,0 +1,393 @@
+// Command amt inspects AMTs stored in a CAR file or a directory of blocks.
+//
+// Usage:
+//
+//	amt <command> [flags] <args>
+//
+// Commands:
+//
+//	get <root> <index>         print the value at index
+//	ls <root>                  print the values in [--from, --to)
+//	stats <root>               print statistics about the AMT's shape
+//	diff <a> <b>               print the changes from AMT a to AMT b
+//	validate <root>            check every node of the AMT
+//	dump <root>                print the AMT's structure as text or DOT
+//	build --out <car> <input>  build an AMT from index and value pairs
+//
+// Blocks are read from the CAR file given with --car, or from the directory
+// given with --dir, which holds one file per block named by its CID. Every
+// block is checked against its CID. --bitwidth is the bitwidth of the AMT, or
+// auto (the default) to take it from the root. Output is one JSON object per
+// line, with values as hex, or with --output=diag, one object per line in CBOR
+// diagnostic notation.
+//
+// build reads {"index":N,"value":V} lines, where values are DAG-JSON or, with
+// --values=hex, hex encoded CBOR, or with --input=cbor a CBOR sequence of
+// [index, value] arrays. It writes the AMT to the CAR file given with --out and
+// prints its root. The same pairs always give the same CAR.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	cbg "github.com/whyrusleeping/cbor-gen"
+
+	amt "github.com/filecoin-project/go-amt-ipld/v4"
+	"github.com/filecoin-project/go-amt-ipld/v4/internal"
+)
+
+type command struct {
+	args  string
+	usage string
+	run   func(ctx context.Context, args []string, stdout io.Writer) error
+}
+
+var commands = map[string]command{
+	"build":    {"--out <car> <input>", "build an AMT from index and value pairs", runBuild},
+	"get":      {"<root> <index>", "print the value at index", runGet},
+	"ls":       {"<root>", "print the values in [--from, --to)", runLs},
+	"stats":    {"<root>", "print statistics about the AMT's shape", runStats},
+	"diff":     {"<a> <b>", "print the changes from AMT a to AMT b", runDiff},
+	"validate": {"<root>", "check every node of the AMT", runValidate},
+	"dump":     {"<root>", "print the AMT's structure as text or DOT", runDump},
+}
+
+func main() {
+	if err := run(context.Background(), os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "amt:", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(usage())
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown command %q\n%s", args[0], usage())
+	}
+	return cmd.run(ctx, args[1:], stdout)
+}
+
+func usage() string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	s := "usage: amt <command> [flags] <args>\ncommands:"
+	for _, name := range names {
+		cmd := commands[name]
+		s += fmt.Sprintf("\n  %-26s %s", name+" "+cmd.args, cmd.usage)
+	}
+	return s
+}
+
+// common holds the flags shared by every command.
+type common struct {
+	car, dir string
+	bitWidth string
+	output   string
+
+	store cbor.IpldStore
+	out   *printer
+}
+
+func newFlagSet(name string) (*flag.FlagSet, *common) {
+	c := new(common)
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.StringVar(&c.car, "car", "", "read blocks from this CAR file")
+	fs.StringVar(&c.dir, "dir", "", "read blocks from this directory, one file per block named by its CID")
+	fs.StringVar(&c.bitWidth, "bitwidth", "auto", "bitwidth of the AMT, or auto to read it from the root")
+	fs.StringVar(&c.output, "output", "json", "output format, json or diag")
+	return fs, c
+}
+
+// parse parses flags given anywhere among the positional arguments, checks
+// there is one of the latter for each name, and opens the block store.
+func (c *common) parse(fs *flag.FlagSet, args []string, stdout io.Writer, names ...string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(positional) != len(names) {
+		return nil, fmt.Errorf("usage: amt %s [flags] <%s>", fs.Name(), strings.Join(names, "> <"))
+	}
+
+	var err error
+	if c.out, err = newPrinter(stdout, c.output); err != nil {
+		return nil, err
+	}
+
+	var bs *blockstore
+	switch {
+	case c.car != "" && c.dir != "":
+		return nil, errors.New("only one of --car and --dir may be given")
+	case c.car != "":
+		bs, err = openCAR(c.car)
+	case c.dir != "":
+		bs, err = openDir(c.dir)
+	default:
+		return nil, errors.New("one of --car or --dir is required")
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.store = cbor.NewCborStore(bs)
+	return positional, nil
+}
+
+// options returns the options for loading the AMT at root.
+func (c *common) options(ctx context.Context, root cid.Cid) ([]amt.Option, error) {
+	if c.bitWidth != "auto" {
+		bw, err := strconv.ParseUint(c.bitWidth, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bitwidth %q", c.bitWidth)
+		}
+		return []amt.Option{amt.UseTreeBitWidth(uint(bw))}, nil
+	}
+
+	var r internal.Root
+	if err := c.store.Get(ctx, root, &r); err != nil {
+		return nil, fmt.Errorf("reading root %s: %w", root, err)
+	}
+	return []amt.Option{amt.UseTreeBitWidth(uint(r.BitWidth))}, nil
+}
+
+// load parses root and loads the AMT there.
+func (c *common) load(ctx context.Context, root string) (*amt.Root, cid.Cid, []amt.Option, error) {
+	rc, err := cid.Decode(root)
+	if err != nil {
+		return nil, cid.Undef, nil, fmt.Errorf("invalid root %q: %w", root, err)
+	}
+	opts, err := c.options(ctx, rc)
+	if err != nil {
+		return nil, cid.Undef, nil, err
+	}
+	a, err := amt.LoadAMT(ctx, c.store, rc, opts...)
+	if err != nil {
+		return nil, cid.Undef, nil, err
+	}
+	return a, rc, opts, nil
+}
+
+func parseIndex(s string) (uint64, error) {
+	i, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || i > amt.MaxIndex {
+		return 0, fmt.Errorf("invalid index %q", s)
+	}
+	return i, nil
+}
+
+func runGet(ctx context.Context, args []string, stdout io.Writer) error {
+	fs, c := newFlagSet("get")
+	args, err := c.parse(fs, args, stdout, "root", "index")
+	if err != nil {
+		return err
+	}
+	a, _, _, err := c.load(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	i, err := parseIndex(args[1])
+	if err != nil {
+		return err
+	}
+
+	var v cbg.Deferred
+	found, err := a.Get(ctx, i, &v)
+	if err != nil {
+		return err
+	} else if !found {
+		return fmt.Errorf("index %d is not set", i)
+	}
+	return c.out.print(record{{"index", i}, {"value", &v}})
+}
+
+// errStop ends an iteration early.
+var errStop = errors.New("stop")
+
+func runLs(ctx context.Context, args []string, stdout io.Writer) error {
+	fs, c := newFlagSet("ls")
+	from := fs.Uint64("from", 0, "first index to list")
+	to := fs.Uint64("to", amt.MaxIndex+1, "index to stop listing at, exclusive")
+	args, err := c.parse(fs, args, stdout, "root")
+	if err != nil {
+		return err
+	}
+	a, _, _, err := c.load(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	err = a.ForEachAt(ctx, *from, func(i uint64, v *cbg.Deferred) error {
+		if i >= *to {
+			return errStop
+		}
+		return c.out.print(record{{"index", i}, {"value", v}})
+	})
+	if err != nil && err != errStop {
+		return err
+	}
+	return nil
+}
+
+func runStats(ctx context.Context, args []string, stdout io.Writer) error {
+	fs, c := newFlagSet("stats")
+	sample := fs.Float64("sample", 1, "fraction of leaves to visit, estimating the figures for the rest")
+	seed := fs.Int64("seed", 0, "seed for choosing the leaves to sample")
+	args, err := c.parse(fs, args, stdout, "root")
+	if err != nil {
+		return err
+	}
+	a, rc, _, err := c.load(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	var stats *amt.Stats
+	if *sample < 1 {
+		stats, err = a.SampleStats(ctx, *sample, *seed)
+	} else {
+		stats, err = a.Stats(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	levels := make([]record, len(stats.Levels))
+	for h, ls := range stats.Levels {
+		levels[h] = record{
+			{"height", h},
+			{"nodes", ls.Nodes},
+			{"slots", ls.Slots},
+			{"fill", ls.FillRatio},
+			{"bytes", ls.Bytes},
+		}
+	}
+	return c.out.print(record{
+		{"root", rc.String()},
+		{"bitwidth", stats.BitWidth},
+		{"height", stats.Height},
+		{"count", stats.Count},
+		{"maxIndex", stats.MaxIndex},
+		{"density", stats.Density},
+		{"sampled", stats.Sampled},
+		{"levels", levels},
+		{"valueSizes", stats.ValueSizes},
+	})
+}
+
+func runDiff(ctx context.Context, args []string, stdout io.Writer) error {
+	fs, c := newFlagSet("diff")
+	args, err := c.parse(fs, args, stdout, "a", "b")
+	if err != nil {
+		return err
+	}
+	_, prev, opts, err := c.load(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	_, cur, _, err := c.load(ctx, args[1])
+	if err != nil {
+		return err
+	}
+
+	changes, err := amt.Diff(ctx, c.store, c.store, prev, cur, opts...)
+	if err != nil {
+		return err
+	}
+	for _, ch := range changes {
+		if err := c.out.print(record{
+			{"type", ch.Type.String()},
+			{"key", ch.Key},
+			{"before", ch.Before},
+			{"after", ch.After},
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runValidate(ctx context.Context, args []string, stdout io.Writer) error {
+	fs, c := newFlagSet("validate")
+	args, err := c.parse(fs, args, stdout, "root")
+	if err != nil {
+		return err
+	}
+	a, rc, opts, err := c.load(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	nodes, values := 0, uint64(0)
+	err = amt.WalkNodes(ctx, c.store, rc, func(info amt.NodeInfo) error {
+		nodes++
+		if info.Height == 0 {
+			values += uint64(info.Slots)
+		}
+		return nil
+	}, opts...)
+	if err != nil {
+		return err
+	}
+	if values != a.Len() {
+		return fmt.Errorf("root %s claims %d values but holds %d", rc, a.Len(), values)
+	}
+	return c.out.print(record{{"root", rc.String()}, {"valid", true}, {"nodes", nodes}, {"count", values}})
+}
+
+func runDump(ctx context.Context, args []string, stdout io.Writer) error {
+	fs, c := newFlagSet("dump")
+	format := fs.String("format", "text", "dump format, text or dot")
+	depth := fs.Int("depth", -1, "only dump nodes up to this many links below the root")
+	from := fs.Uint64("from", 0, "only dump nodes and values from this index")
+	to := fs.Uint64("to", amt.MaxIndex+1, "only dump nodes and values before this index")
+	hexValues := fs.Bool("hex", false, "print values as hex rather than diagnostic CBOR")
+	args, err := c.parse(fs, args, stdout, "root")
+	if err != nil {
+		return err
+	}
+	a, _, _, err := c.load(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	var df amt.DumpFormat
+	switch *format {
+	case "text":
+		df = amt.DumpText
+	case "dot":
+		df = amt.DumpDOT
+	default:
+		return fmt.Errorf("unknown dump format %q, expected text or dot", *format)
+	}
+	opts := []amt.DumpOption{amt.DumpRange(*from, *to)}
+	if *depth >= 0 {
+		opts = append(opts, amt.DumpMaxDepth(*depth))
+	}
+	if *hexValues {
+		opts = append(opts, amt.DumpHexValues())
+	}
+	return a.Dump(ctx, stdout, df, opts...)
+}
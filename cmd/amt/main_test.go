@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/stretchr/testify/require"
+	cbg "github.com/whyrusleeping/cbor-gen"
+
+	amt "github.com/filecoin-project/go-amt-ipld/v4"
+	"github.com/filecoin-project/go-amt-ipld/v4/internal"
+)
+
+// writeFixture builds two versions of an AMT and writes both to a CAR file
+// and a block directory, returning their paths and roots.
+func writeFixture(t *testing.T) (string, string, cid.Cid, cid.Cid) {
+	ctx := context.Background()
+	bs := &blockstore{blocks: make(map[cid.Cid][]byte)}
+	store := cbor.NewCborStore(bs)
+
+	a, err := amt.NewAMT(store, amt.UseTreeBitWidth(2))
+	require.NoError(t, err)
+	for i := uint64(0); i < 20; i += 2 {
+		v := cbg.CborInt(i)
+		require.NoError(t, a.Set(ctx, i, &v))
+	}
+	prev, err := a.Flush(ctx)
+	require.NoError(t, err)
+	v := cbg.CborInt(100)
+	require.NoError(t, a.Set(ctx, 4, &v))
+	require.NoError(t, a.Set(ctx, 21, &v))
+	cur, err := a.Flush(ctx)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	carPath := filepath.Join(dir, "amt.car")
+	var buf bytes.Buffer
+	require.NoError(t, amt.ExportCAR(ctx, store, cur, &buf, amt.UseTreeBitWidth(2)))
+	// append the blocks only used by prev, so both roots can be read
+	require.NoError(t, amt.NewBlocks(ctx, store, cur, prev, func(c cid.Cid, data []byte) error {
+		return internal.WriteCARBlock(&buf, c, data)
+	}, amt.UseTreeBitWidth(2)))
+	require.NoError(t, os.WriteFile(carPath, buf.Bytes(), 0o644))
+
+	blockDir := filepath.Join(dir, "blocks")
+	require.NoError(t, os.Mkdir(blockDir, 0o755))
+	for c, data := range bs.blocks {
+		require.NoError(t, os.WriteFile(filepath.Join(blockDir, c.String()), data, 0o644))
+	}
+	return carPath, blockDir, prev, cur
+}
+
+func runCommand(t *testing.T, args ...string) (string, error) {
+	var out bytes.Buffer
+	err := run(context.Background(), args, &out)
+	return out.String(), err
+}
+
+func TestCommands(t *testing.T) {
+	carPath, blockDir, prev, cur := writeFixture(t)
+
+	for _, source := range [][]string{{"--car", carPath}, {"--dir", blockDir}} {
+		out, err := runCommand(t, append([]string{"get", cur.String(), "4"}, source...)...)
+		require.NoError(t, err)
+		require.Equal(t, `{"index":4,"value":"1864"}`+"\n", out)
+
+		out, err = runCommand(t, append([]string{"get", "--output=diag", cur.String(), "4"}, source...)...)
+		require.NoError(t, err)
+		require.Equal(t, `{"index": 4, "value": 100}`+"\n", out)
+
+		_, err = runCommand(t, append([]string{"get", cur.String(), "5"}, source...)...)
+		require.ErrorContains(t, err, "not set")
+
+		out, err = runCommand(t, append([]string{"ls", cur.String(), "--from", "5", "--to", "10", "--output", "diag"}, source...)...)
+		require.NoError(t, err)
+		require.Equal(t, `{"index": 6, "value": 6}`+"\n"+`{"index": 8, "value": 8}`+"\n", out)
+
+		out, err = runCommand(t, append([]string{"diff", prev.String(), cur.String(), "--output=diag"}, source...)...)
+		require.NoError(t, err)
+		require.Equal(t, `{"type": "modify", "key": 4, "before": 4, "after": 100}`+"\n"+
+			`{"type": "add", "key": 21, "before": undefined, "after": 100}`+"\n", out)
+
+		out, err = runCommand(t, append([]string{"validate", cur.String(), "--bitwidth", "2"}, source...)...)
+		require.NoError(t, err)
+		require.Contains(t, out, `"valid":true`)
+		require.Contains(t, out, `"count":11`)
+
+		out, err = runCommand(t, append([]string{"stats", cur.String()}, source...)...)
+		require.NoError(t, err)
+		require.Contains(t, out, `"maxIndex":21`)
+
+		out, err = runCommand(t, append([]string{"dump", cur.String(), "--format=dot"}, source...)...)
+		require.NoError(t, err)
+		require.True(t, strings.HasPrefix(out, "digraph amt {"))
+	}
+
+	// a mismatched bitwidth is rejected
+	_, err := runCommand(t, "validate", cur.String(), "--car", carPath, "--bitwidth", "3")
+	require.Error(t, err)
+
+	// as is a corrupted block
+	data, err := os.ReadFile(filepath.Join(blockDir, cur.String()))
+	require.NoError(t, err)
+	data[len(data)-1] ^= 1
+	require.NoError(t, os.WriteFile(filepath.Join(blockDir, cur.String()), data, 0o644))
+	_, err = runCommand(t, "validate", cur.String(), "--dir", blockDir)
+	require.ErrorContains(t, err, "doesn't match")
+
+	_, err = runCommand(t, "get", cur.String(), "--car", carPath)
+	require.ErrorContains(t, err, "usage")
+	_, err = runCommand(t, "nope")
+	require.ErrorContains(t, err, "unknown command")
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	cbg "github.com/whyrusleeping/cbor-gen"
+
+	"github.com/filecoin-project/go-amt-ipld/v4/internal"
+)
+
+// field is a named value in a record printed by a printer. Values are
+// integers, floats, strings, bools, CBOR values (*cbg.Deferred, nil for an
+// absent value), lists of integers or lists of records.
+type field struct {
+	name  string
+	value any
+}
+
+type record []field
+
+// printer writes one record per line, either as JSON, with CBOR values as hex
+// strings, or in CBOR diagnostic notation.
+type printer struct {
+	w    io.Writer
+	diag bool
+}
+
+func newPrinter(w io.Writer, format string) (*printer, error) {
+	switch format {
+	case "json":
+		return &printer{w: w}, nil
+	case "diag":
+		return &printer{w: w, diag: true}, nil
+	default:
+		return nil, fmt.Errorf("unknown output format %q, expected json or diag", format)
+	}
+}
+
+func (p *printer) print(r record) error {
+	var b strings.Builder
+	if err := p.record(&b, r); err != nil {
+		return err
+	}
+	b.WriteByte('\n')
+	_, err := io.WriteString(p.w, b.String())
+	return err
+}
+
+func (p *printer) record(b *strings.Builder, r record) error {
+	b.WriteByte('{')
+	for i, f := range r {
+		if i > 0 {
+			p.sep(b)
+		}
+		b.WriteString(strconv.Quote(f.name))
+		if p.diag {
+			b.WriteString(": ")
+		} else {
+			b.WriteString(":")
+		}
+		if err := p.value(b, f.value); err != nil {
+			return fmt.Errorf("field %s: %w", f.name, err)
+		}
+	}
+	b.WriteByte('}')
+	return nil
+}
+
+func (p *printer) value(b *strings.Builder, v any) error {
+	switch v := v.(type) {
+	case *cbg.Deferred:
+		switch {
+		case v == nil && p.diag:
+			b.WriteString("undefined")
+		case v == nil:
+			b.WriteString("null")
+		case p.diag:
+			s, err := internal.Diagnostic(v.Raw)
+			if err != nil {
+				return err
+			}
+			b.WriteString(s)
+		default:
+			b.WriteString(strconv.Quote(hex.EncodeToString(v.Raw)))
+		}
+	case float64:
+		if p.diag {
+			s := strconv.FormatFloat(v, 'g', -1, 64)
+			if !strings.ContainsAny(s, ".eEIN") {
+				s += ".0"
+			}
+			b.WriteString(s)
+			return nil
+		}
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Errorf("%v can't be represented in JSON", v)
+		}
+		b.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+	case []uint64:
+		b.WriteByte('[')
+		for i, n := range v {
+			if i > 0 {
+				p.sep(b)
+			}
+			b.WriteString(strconv.FormatUint(n, 10))
+		}
+		b.WriteByte(']')
+	case []record:
+		b.WriteByte('[')
+		for i, r := range v {
+			if i > 0 {
+				p.sep(b)
+			}
+			if err := p.record(b, r); err != nil {
+				return err
+			}
+		}
+		b.WriteByte(']')
+	case string, bool, int, uint, uint64:
+		// these encode the same way in both formats
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		b.Write(data)
+	default:
+		return fmt.Errorf("unsupported value type %T", v)
+	}
+	return nil
+}
+
+func (p *printer) sep(b *strings.Builder) {
+	if p.diag {
+		b.WriteString(", ")
+	} else {
+		b.WriteByte(',')
+	}
+}
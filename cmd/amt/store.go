@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	block "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+
+	"github.com/filecoin-project/go-amt-ipld/v4/internal"
+)
+
+// blockstore serves blocks read from a CAR file, or stored in a directory as
+// one file per block named by its CID. Every block is checked against its CID
+// as it is read.
+type blockstore struct {
+	dir    string
+	blocks map[cid.Cid][]byte
+}
+
+// openCAR reads every block of a CARv1 file into memory.
+func openCAR(path string) (*blockstore, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() //nolint:errcheck
+
+	br := bufio.NewReader(f)
+	if _, err := internal.ReadCARHeader(br); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	bs := &blockstore{blocks: make(map[cid.Cid][]byte)}
+	for {
+		c, data, err := internal.ReadCARBlock(br)
+		if err == io.EOF {
+			return bs, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if err := internal.CheckBlock(c, data); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		bs.blocks[c] = data
+	}
+}
+
+// openDir serves the blocks stored in dir, which must exist.
+func openDir(dir string) (*blockstore, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	return &blockstore{dir: dir}, nil
+}
+
+func (bs *blockstore) Get(_ context.Context, c cid.Cid) (block.Block, error) {
+	var data []byte
+	if bs.dir == "" {
+		var ok bool
+		if data, ok = bs.blocks[c]; !ok {
+			return nil, fmt.Errorf("block %s not found", c)
+		}
+	} else {
+		var err error
+		data, err = os.ReadFile(filepath.Join(bs.dir, c.String()))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("block %s not found", c)
+		} else if err != nil {
+			return nil, err
+		}
+		if err := internal.CheckBlock(c, data); err != nil {
+			return nil, err
+		}
+	}
+	return block.NewBlockWithCid(data, c)
+}
+
+func (bs *blockstore) Put(_ context.Context, b block.Block) error {
+	if bs.dir == "" {
+		bs.blocks[b.Cid()] = b.RawData()
+		return nil
+	}
+	return os.WriteFile(filepath.Join(bs.dir, b.Cid().String()), b.RawData(), 0o644)
+}
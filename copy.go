@@ -0,0 +1,218 @@
+package amt
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-amt-ipld/v4/internal"
+)
+
+// copyWorkers is the maximum number of nodes Copy loads and stores at once.
+const copyWorkers = 16
+
+// CopyStats reports the work done by Copy.
+type CopyStats struct {
+	// Blocks is the number of blocks written to the destination.
+	Blocks uint64
+	// Bytes is the total size of the blocks written to the destination.
+	Bytes uint64
+}
+
+// blockChecker is implemented by stores that can cheaply tell whether they
+// already hold a block.
+type blockChecker interface {
+	Has(ctx context.Context, c cid.Cid) (bool, error)
+}
+
+// Copy copies every block of the AMT at root from src to dst, passing the
+// serialized blocks through unchanged.
+//
+// If dst implements Has(ctx, cid.Cid) (bool, error), blocks it already holds
+// are assumed to have their entire subtree present and are not copied again.
+// Copy maintains this property itself by writing each node only after all of
+// its children, and the root block last, so an interrupted copy can simply be
+// restarted. Values are never inspected, so any CIDs embedded in values are
+// not followed.
+func Copy(ctx context.Context, src, dst cbor.IpldStore, root cid.Cid, opts ...Option) (*CopyStats, error) {
+	cfg := defaultConfig()
+	for _, opt := range opts {
+		if err := opt(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	c := &copier{
+		lc:      newLoadChecker(cfg),
+		src:     cfg.wrapStore(src, nil),
+		dst:     cfg.wrapStore(dst, nil),
+		workers: make(chan struct{}, copyWorkers),
+		claims:  make(map[cid.Cid]*copyClaim),
+	}
+	c.has, _ = dst.(blockChecker)
+
+	if done, err := c.present(ctx, root); err != nil || done {
+		return c.result(), err
+	}
+	b, err := getRawBlock(ctx, c.src, root)
+	if err != nil {
+		return nil, xerrors.Errorf("loading root: %w", err)
+	}
+	var r internal.Root
+	if err := r.UnmarshalCBOR(bytes.NewReader(b.data)); err != nil {
+		return nil, withBlock(malformedf("decoding root: %w", err), root, -1)
+	}
+	if err := checkRoot(&r, cfg); err != nil {
+		return nil, withBlock(err, root, int(r.Height))
+	}
+	if err := c.lc.root(b.data); err != nil {
+		return nil, blockError(err, root, int(r.Height))
+	}
+	nd, err := newNode(r.Node, cfg.bitWidth, r.Height == 0, r.Height == 0)
+	if err != nil {
+		return nil, withBlock(err, root, int(r.Height))
+	}
+	if err := c.children(ctx, nd, cfg.bitWidth, int(r.Height)); err != nil {
+		return nil, err
+	}
+	if err := c.put(ctx, b); err != nil {
+		return nil, err
+	}
+	return c.result(), nil
+}
+
+type copier struct {
+	lc       *loadChecker
+	src, dst cbor.IpldStore
+	has      blockChecker
+	workers  chan struct{}
+
+	lk     sync.Mutex
+	claims map[cid.Cid]*copyClaim
+
+	blocks, bytes atomic.Uint64
+}
+
+func (c *copier) result() *CopyStats {
+	return &CopyStats{Blocks: c.blocks.Load(), Bytes: c.bytes.Load()}
+}
+
+// copyClaim tracks the copy of a node that may be reached more than once, as
+// identical subtrees share a CID.
+type copyClaim struct {
+	done chan struct{}
+	err  error
+}
+
+// claim returns the claim on node id and whether the caller now owns it. The
+// owner must release the claim once the node and its subtree are stored.
+func (c *copier) claim(id cid.Cid) (*copyClaim, bool) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	if cl, ok := c.claims[id]; ok {
+		return cl, false
+	}
+	cl := &copyClaim{done: make(chan struct{})}
+	c.claims[id] = cl
+	return cl, true
+}
+
+// present reports whether dst is known to hold block id already.
+func (c *copier) present(ctx context.Context, id cid.Cid) (bool, error) {
+	if c.has == nil {
+		return false, nil
+	}
+	return c.has.Has(ctx, id)
+}
+
+func (c *copier) put(ctx context.Context, b *rawBlock) error {
+	if err := putRawBlock(ctx, c.dst, b); err != nil {
+		return err
+	}
+	c.blocks.Add(1)
+	c.bytes.Add(uint64(len(b.data)))
+	return nil
+}
+
+// children copies the subtrees below n, a node at the given height. Subtrees
+// are handed to another goroutine while a worker slot is free and copied by
+// the calling goroutine otherwise, so the number of goroutines is bounded
+// without ever blocking on a slot.
+func (c *copier) children(ctx context.Context, n *node, bitWidth uint, height int) error {
+	if height == 0 {
+		return nil
+	}
+	grp, ctx := errgroup.WithContext(ctx)
+	for _, ln := range n.links {
+		if ln == nil {
+			continue
+		}
+		id := ln.cid
+		select {
+		case c.workers <- struct{}{}:
+			grp.Go(func() error {
+				defer func() { <-c.workers }()
+				return c.node(ctx, id, bitWidth, height-1)
+			})
+		default:
+			if err := c.node(ctx, id, bitWidth, height-1); err != nil {
+				// wait for the subtrees already handed off before returning
+				_ = grp.Wait()
+				return err
+			}
+		}
+	}
+	return grp.Wait()
+}
+
+// node copies the node id at the given height, and everything below it. A
+// node reached a second time is copied once, with the second caller waiting
+// for it so that no parent is stored before its subtree is complete.
+func (c *copier) node(ctx context.Context, id cid.Cid, bitWidth uint, height int) error {
+	cl, owner := c.claim(id)
+	if !owner {
+		select {
+		case <-cl.done:
+			return cl.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	cl.err = c.copyNode(ctx, id, bitWidth, height)
+	close(cl.done)
+	return cl.err
+}
+
+func (c *copier) copyNode(ctx context.Context, id cid.Cid, bitWidth uint, height int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if done, err := c.present(ctx, id); err != nil || done {
+		return err
+	}
+	b, err := getRawBlock(ctx, c.src, id)
+	if err != nil {
+		return err
+	}
+	if err := c.lc.node(b.data); err != nil {
+		return blockError(err, id, height)
+	}
+	var nd internal.Node
+	if err := nd.UnmarshalCBOR(bytes.NewReader(b.data)); err != nil {
+		return withBlock(malformedf("decoding node: %w", err), id, height)
+	}
+	n, err := newNode(nd, bitWidth, false, height == 0)
+	if err != nil {
+		return withBlock(err, id, height)
+	}
+	if err := c.children(ctx, n, bitWidth, height); err != nil {
+		return err
+	}
+	return c.put(ctx, b)
+}
@@ -0,0 +1,82 @@
+package amt
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/stretchr/testify/require"
+)
+
+// checkingStore is an IpldStore that can tell whether it holds a block.
+type checkingStore struct {
+	cbor.IpldStore
+	mock *mockBlocks
+}
+
+func newCheckingStore() *checkingStore {
+	mock := newMockBlocks()
+	return &checkingStore{IpldStore: cbor.NewCborStore(mock), mock: mock}
+}
+
+func (cs *checkingStore) Has(_ context.Context, c cid.Cid) (bool, error) {
+	cs.mock.dataMu.Lock()
+	defer cs.mock.dataMu.Unlock()
+	_, ok := cs.mock.data[c]
+	return ok, nil
+}
+
+func TestCopy(t *testing.T) {
+	runTestWithBitWidths(t, bitWidths2to18, func(t *testing.T, opts ...Option) {
+		ctx := context.Background()
+		src := cbor.NewCborStore(newMockBlocks())
+
+		a, err := NewAMT(src, opts...)
+		require.NoError(t, err)
+		for i := uint64(0); i < 1000; i++ {
+			assertSet(t, a, i, "value")
+		}
+		assertSet(t, a, 1<<20, "far")
+		first, err := a.Flush(ctx)
+		require.NoError(t, err)
+		assertSet(t, a, 500, "changed")
+		second, err := a.Flush(ctx)
+		require.NoError(t, err)
+
+		// into an empty store
+		full := newCheckingStore()
+		stats, err := Copy(ctx, src, full, second, opts...)
+		require.NoError(t, err)
+		require.Equal(t, uint64(len(full.mock.data)), stats.Blocks)
+		require.NotZero(t, stats.Bytes)
+
+		// into a store already holding an earlier version
+		partial := newCheckingStore()
+		_, err = Copy(ctx, src, partial, first, opts...)
+		require.NoError(t, err)
+		partialStats, err := Copy(ctx, src, partial, second, opts...)
+		require.NoError(t, err)
+		if a.height > 0 {
+			require.Less(t, partialStats.Blocks, stats.Blocks)
+		}
+		for c := range full.mock.data {
+			require.Contains(t, partial.mock.data, c)
+		}
+
+		b, err := LoadAMT(ctx, partial, second, opts...)
+		require.NoError(t, err)
+		assertCount(t, b, 1001)
+		assertGet(ctx, t, b, 500, "changed")
+		assertGet(ctx, t, b, 1<<20, "far")
+
+		// copying again is a no-op
+		stats, err = Copy(ctx, src, partial, second, opts...)
+		require.NoError(t, err)
+		require.Zero(t, stats.Blocks)
+
+		// missing blocks in the source are reported
+		_, err = Copy(ctx, cbor.NewCborStore(newMockBlocks()), newCheckingStore(), second, opts...)
+		require.Error(t, err)
+	})
+}
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"fmt"
 
 	"golang.org/x/xerrors"
 
@@ -39,48 +38,144 @@ func (ch Change) String() string {
 }
 
 // Diff returns a set of changes that transform node 'a' into node 'b'. opts are applied to both prev and cur.
-func Diff(ctx context.Context, prevBs, curBs cbor.IpldStore, prev, cur cid.Cid, opts ...Option) ([]*Change, error) {
+func Diff(ctx context.Context, prevBs, curBs cbor.IpldStore, prev, cur cid.Cid, opts ...Option) (_ []*Change, err error) {
+	ctx, sp, opts, err := startDiffSpan(ctx, "Diff", opts)
+	if err != nil {
+		return nil, err
+	}
+	if sp != nil {
+		defer func() { sp.end(err) }()
+	}
+
+	var cc changeCollector
+	if err := diff(ctx, prevBs, curBs, prev, cur, &cc, opts...); err != nil {
+		return nil, err
+	}
+	return cc.changes, nil
+}
+
+// DiffAvailable returns the changes between prev and cur like Diff, but where
+// a node of either AMT isn't found in its store, the subtree below it is
+// skipped rather than failing the diff. Each such subtree is passed to
+// missing, and changes within its range of indexes aren't returned. Returning
+// an error from missing stops the diff. Both roots must be available, and any
+// other error loading a node still fails the diff.
+func DiffAvailable(ctx context.Context, prevBs, curBs cbor.IpldStore, prev, cur cid.Cid, missing func(MissingNode) error, opts ...Option) (_ []*Change, err error) {
+	ctx, sp, opts, err := startDiffSpan(ctx, "DiffAvailable", opts)
+	if err != nil {
+		return nil, err
+	}
+	if sp != nil {
+		defer func() { sp.end(err) }()
+	}
+
+	var cc changeCollector
+	if err := diffAvailable(ctx, prevBs, curBs, prev, cur, &cc, missing, opts...); err != nil {
+		return nil, err
+	}
+	return cc.changes, nil
+}
+
+// diff loads the prev and cur roots and reports the differences between them
+// to v.
+func diff(ctx context.Context, prevBs, curBs cbor.IpldStore, prev, cur cid.Cid, v diffVisitor, opts ...Option) error {
+	return diffAvailable(ctx, prevBs, curBs, prev, cur, v, nil, opts...)
+}
+
+// diffAvailable is diff, but where missing is non-nil, subtrees whose nodes
+// aren't found in the store are passed to missing and skipped.
+func diffAvailable(ctx context.Context, prevBs, curBs cbor.IpldStore, prev, cur cid.Cid, v diffVisitor, missing func(MissingNode) error, opts ...Option) error {
 	prevAmt, err := LoadAMT(ctx, prevBs, prev, opts...)
 	if err != nil {
-		return nil, xerrors.Errorf("loading previous root: %w", err)
+		return xerrors.Errorf("loading previous root: %w", err)
 	}
 
 	prevCtx := &nodeContext{
-		bs:       prevBs,
+		bs:       prevAmt.store,
 		bitWidth: prevAmt.bitWidth,
 		height:   prevAmt.height,
+		missing:  missing,
 	}
 
 	curAmt, err := LoadAMT(ctx, curBs, cur, opts...)
 	if err != nil {
-		return nil, xerrors.Errorf("loading current root: %w", err)
+		return xerrors.Errorf("loading current root: %w", err)
 	}
 
 	// TODO: remove when https://github.com/filecoin-project/go-amt-ipld/issues/54 is closed.
 	if curAmt.bitWidth != prevAmt.bitWidth {
-		return nil, xerrors.Errorf("diffing AMTs with differing bitWidths not supported (prev=%d, cur=%d)", prevAmt.bitWidth, curAmt.bitWidth)
+		return xerrors.Errorf("%w: diffing AMTs with differing bitWidths not supported (prev=%d, cur=%d)", ErrBitWidthMismatch, prevAmt.bitWidth, curAmt.bitWidth)
 	}
 
 	curCtx := &nodeContext{
-		bs:       curBs,
+		bs:       curAmt.store,
 		bitWidth: curAmt.bitWidth,
 		height:   curAmt.height,
+		missing:  missing,
 	}
 
-	// edge case of diffing an empty AMT against non-empty
-	if prevAmt.count == 0 && curAmt.count != 0 {
-		return addAll(ctx, curCtx, curAmt.node, 0)
-	}
-	if prevAmt.count != 0 && curAmt.count == 0 {
-		return removeAll(ctx, prevCtx, prevAmt.node, 0)
+	return diffAt(ctx, max(prevAmt.height, curAmt.height), 0, rootSide(prevAmt, prevCtx, cid.Undef), rootSide(curAmt, curCtx, cid.Undef), v)
+}
+
+// diffVisitor receives the differences found by diffAt. Subtrees that only
+// exist on one side are handed over as links, without being loaded, so a
+// visitor that doesn't need their values can avoid decoding them.
+type diffVisitor interface {
+	// subtree is called for a subtree that only exists in prev (Remove) or
+	// only exists in cur (Add). nc describes the node behind ln, and offset is
+	// the index of its left-most element.
+	subtree(ctx context.Context, typ ChangeType, nc *nodeContext, ln *link, offset uint64) error
+	// nodes is called with the links to a pair of differing nodes before
+	// diffAt loads and compares them. Where only one side's node is a block
+	// of its own at that height, because the other is a root, the other link
+	// is nil.
+	nodes(prev, cur *link) error
+	// change is called for each differing value found when comparing leaves.
+	change(typ ChangeType, key uint64, before, after *cbg.Deferred) error
+}
+
+// changeCollector is the diffVisitor backing Diff, it accumulates a Change for
+// each differing value.
+type changeCollector struct {
+	changes []*Change
+}
+
+func (cc *changeCollector) subtree(ctx context.Context, typ ChangeType, nc *nodeContext, ln *link, offset uint64) error {
+	n, err := nc.load(ctx, ln, offset)
+	if err != nil || n == nil {
+		return err
 	}
-	return diffNode(ctx, prevCtx, curCtx, prevAmt.node, curAmt.node, 0)
+
+	return n.forEachAvailable(ctx, nc.bs, nc.bitWidth, nc.height, 0, offset, func(index uint64, deferred *cbg.Deferred) error {
+		if typ == Add {
+			return cc.change(Add, index, nil, deferred)
+		}
+		return cc.change(Remove, index, deferred, nil)
+	}, nc.missing)
+}
+
+func (cc *changeCollector) nodes(_, _ *link) error {
+	return nil
+}
+
+func (cc *changeCollector) change(typ ChangeType, key uint64, before, after *cbg.Deferred) error {
+	cc.changes = append(cc.changes, &Change{
+		Type:   typ,
+		Key:    key,
+		Before: before,
+		After:  after,
+	})
+	return nil
 }
 
 type nodeContext struct {
 	bs       cbor.IpldStore // store containining AMT data
 	bitWidth uint           // bit width of AMT
 	height   int            // height of node
+
+	// missing, where non-nil, is passed the nodes that aren't found in bs,
+	// which are then skipped, see load.
+	missing func(MissingNode) error
 }
 
 // nodesAtHeight returns the number of nodes that can be held at the context height
@@ -88,265 +183,151 @@ func (nc *nodeContext) nodesAtHeight() uint64 {
 	return nodesForHeight(nc.bitWidth, nc.height)
 }
 
-func diffNode(ctx context.Context, prevCtx, curCtx *nodeContext, prev, cur *node, offset uint64) ([]*Change, error) {
-	if prev == nil && cur == nil {
-		return nil, nil
+// child returns the context of the nodes one level below this one.
+func (nc *nodeContext) child() *nodeContext {
+	return &nodeContext{
+		bs:       nc.bs,
+		bitWidth: nc.bitWidth,
+		height:   nc.height - 1,
+		missing:  nc.missing,
 	}
+}
 
-	if prev == nil {
-		return addAll(ctx, curCtx, cur, offset)
+// load loads the node behind ln, a node in this context whose left-most
+// element is at offset. Where nc.missing is set and the node isn't found in
+// the store, it's passed to nc.missing and a nil node is returned.
+func (nc *nodeContext) load(ctx context.Context, ln *link, offset uint64) (*node, error) {
+	n, err := ln.load(ctx, nc.bs, nc.bitWidth, nc.height)
+	if nc.missing != nil && isNotFound(err) {
+		return nil, nc.missing(newMissingNode(ln.cid, nc.height, offset, nodesForHeight(nc.bitWidth, nc.height+1)))
 	}
+	return n, err
+}
 
-	if cur == nil {
-		return removeAll(ctx, prevCtx, prev, offset)
-	}
+// side is the subtree one of the AMTs walked by diffAt or Merge holds at a
+// position in the tree. AMTs of different heights are aligned with the tallest
+// one, a shorter AMT's root sitting in the left-most slot of each level it's
+// missing.
+type side struct {
+	// nc describes the node behind ln. Its height is below the height of the
+	// position where the side is a shorter AMT's root.
+	nc *nodeContext
+	// ln links to the subtree, it's nil where the AMT has nothing at this
+	// position.
+	ln *link
+	// id is the CID of the node behind ln. The node of a root is stored inside
+	// the root block, so for a root it's undefined unless given, see
+	// rootNodeCid.
+	id cid.Cid
+}
 
-	if prevCtx.height == 0 && curCtx.height == 0 {
-		return diffLeaves(prev, cur, offset)
+// rootSide returns the side for the root of r, whose nodes are described by
+// nc, with the given id.
+func rootSide(r *Root, nc *nodeContext, id cid.Cid) side {
+	if r.count == 0 {
+		return side{nc: nc}
 	}
+	return side{nc: nc, ln: &link{cached: r.node}, id: id}
+}
 
-	var changes []*Change
-
-	if curCtx.height > prevCtx.height {
-		subCount := curCtx.nodesAtHeight()
-		for i, ln := range cur.links {
-			if ln == nil || ln.cid == cid.Undef {
-				continue
-			}
-
-			subCtx := &nodeContext{
-				bs:       curCtx.bs,
-				bitWidth: curCtx.bitWidth,
-				height:   curCtx.height - 1,
-			}
-
-			subn, err := ln.load(ctx, subCtx.bs, subCtx.bitWidth, subCtx.height)
-			if err != nil {
-				return nil, err
-			}
-
-			offs := offset + (uint64(i) * subCount)
-			if i == 0 {
-				cs, err := diffNode(ctx, prevCtx, subCtx, prev, subn, offs)
-				if err != nil {
-					return nil, err
-				}
-
-				changes = append(changes, cs...)
-			} else {
-				cs, err := addAll(ctx, subCtx, subn, offs)
-				if err != nil {
-					return nil, err
-				}
-
-				changes = append(changes, cs...)
-			}
-		}
-
-		return changes, nil
+// same returns true where both sides are known to hold the same subtree, in
+// which case there's nothing to compare below this position.
+func (s side) same(o side) bool {
+	if s.ln == nil || o.ln == nil {
+		return s.ln == nil && o.ln == nil
 	}
+	return s.id.Defined() && s.id == o.id && s.nc.height == o.nc.height
+}
 
-	if prevCtx.height > curCtx.height {
-		subCount := prevCtx.nodesAtHeight()
-		for i, ln := range prev.links {
-			if ln == nil || ln.cid == cid.Undef {
-				continue
-			}
-
-			subCtx := &nodeContext{
-				bs:       prevCtx.bs,
-				bitWidth: prevCtx.bitWidth,
-				height:   prevCtx.height - 1,
-			}
-
-			subn, err := ln.load(ctx, subCtx.bs, subCtx.bitWidth, subCtx.height)
-			if err != nil {
-				return nil, err
-			}
-
-			offs := offset + (uint64(i) * subCount)
-
-			if i == 0 {
-				cs, err := diffNode(ctx, subCtx, curCtx, subn, cur, offs)
-				if err != nil {
-					return nil, err
-				}
-
-				changes = append(changes, cs...)
-			} else {
-				cs, err := removeAll(ctx, subCtx, subn, offs)
-				if err != nil {
-					return nil, err
-				}
+// stored returns the link to this side's node if it's a block of its own
+// sitting at height h, or nil.
+func (s side) stored(h int) *link {
+	if s.ln == nil || s.nc.height != h || !s.ln.cid.Defined() {
+		return nil
+	}
+	return s.ln
+}
 
-				changes = append(changes, cs...)
+// children returns the subtree this side holds in each slot of the position at
+// height h, where the left-most index is offset. It returns nil where the node
+// is missing from the store, see nodeContext.load.
+func (s side) children(ctx context.Context, h int, offset uint64, bitWidth uint) ([]side, error) {
+	out := make([]side, 1<<bitWidth)
+	switch {
+	case s.ln == nil:
+	case s.nc.height < h:
+		out[0] = s
+	default:
+		n, err := s.nc.load(ctx, s.ln, offset)
+		if err != nil || n == nil {
+			return nil, err
+		}
+		subCtx := s.nc.child()
+		for i := range out {
+			if ln := n.getLink(uint64(i)); ln != nil {
+				out[i] = side{nc: subCtx, ln: ln, id: ln.cid}
 			}
 		}
-
-		return changes, nil
-	}
-
-	// sanity check
-	if prevCtx.height != curCtx.height {
-		return nil, fmt.Errorf("comparing non-leaf nodes of unequal heights (%d, %d)", prevCtx.height, curCtx.height)
 	}
+	return out, nil
+}
 
-	if len(prev.links) != len(cur.links) {
-		return nil, fmt.Errorf("nodes have different numbers of links (prev=%d, cur=%d)", len(prev.links), len(cur.links))
+// diffAt compares the subtrees prev and cur at height h, where the left-most
+// index is offset, reporting the differences to v.
+func diffAt(ctx context.Context, h int, offset uint64, prev, cur side, v diffVisitor) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
-
-	if prev.links == nil || cur.links == nil {
-		return nil, fmt.Errorf("nodes have no links")
+	switch {
+	case prev.same(cur):
+		return nil
+	case prev.ln == nil:
+		return v.subtree(ctx, Add, cur.nc, cur.ln, offset)
+	case cur.ln == nil:
+		return v.subtree(ctx, Remove, prev.nc, prev.ln, offset)
 	}
 
-	subCount := prevCtx.nodesAtHeight()
-	for i := range prev.links {
-		// Neither previous or current links are in use
-		if prev.links[i] == nil && cur.links[i] == nil {
-			continue
-		}
-
-		// Previous had link, current did not
-		if prev.links[i] != nil && cur.links[i] == nil {
-			if prev.links[i].cid == cid.Undef {
-				continue
-			}
-
-			subCtx := &nodeContext{
-				bs:       prevCtx.bs,
-				bitWidth: prevCtx.bitWidth,
-				height:   prevCtx.height - 1,
-			}
-
-			subn, err := prev.links[i].load(ctx, subCtx.bs, subCtx.bitWidth, subCtx.height)
-			if err != nil {
-				return nil, err
-			}
-
-			offs := offset + (uint64(i) * subCount)
-			cs, err := removeAll(ctx, subCtx, subn, offs)
-			if err != nil {
-				return nil, err
-			}
-
-			changes = append(changes, cs...)
-
-			continue
-		}
-
-		// Current has link, previous did not
-		if prev.links[i] == nil && cur.links[i] != nil {
-			if cur.links[i].cid == cid.Undef {
-				continue
-			}
-
-			subCtx := &nodeContext{
-				bs:       curCtx.bs,
-				bitWidth: curCtx.bitWidth,
-				height:   curCtx.height - 1,
-			}
-
-			subn, err := cur.links[i].load(ctx, subCtx.bs, subCtx.bitWidth, subCtx.height)
-			if err != nil {
-				return nil, err
-			}
-
-			offs := offset + (uint64(i) * subCount)
-			cs, err := addAll(ctx, subCtx, subn, offs)
-			if err != nil {
-				return nil, err
-			}
-
-			changes = append(changes, cs...)
-
-			continue
-		}
-
-		// Both previous and current have links to diff
-		if prev.links[i].cid == cur.links[i].cid {
-			continue
-		}
-
-		prevSubCtx := &nodeContext{
-			bs:       prevCtx.bs,
-			bitWidth: prevCtx.bitWidth,
-			height:   prevCtx.height - 1,
+	if p, c := prev.stored(h), cur.stored(h); p != nil || c != nil {
+		if err := v.nodes(p, c); err != nil {
+			return err
 		}
+	}
 
-		prevSubn, err := prev.links[i].load(ctx, prevSubCtx.bs, prevSubCtx.bitWidth, prevSubCtx.height)
-		if err != nil {
-			return nil, err
+	if h == 0 {
+		prevn, err := prev.nc.load(ctx, prev.ln, offset)
+		if err != nil || prevn == nil {
+			return err
 		}
-
-		curSubCtx := &nodeContext{
-			bs:       curCtx.bs,
-			bitWidth: curCtx.bitWidth,
-			height:   curCtx.height - 1,
+		curn, err := cur.nc.load(ctx, cur.ln, offset)
+		if err != nil || curn == nil {
+			return err
 		}
-
-		curSubn, err := cur.links[i].load(ctx, curSubCtx.bs, curSubCtx.bitWidth, curSubCtx.height)
-		if err != nil {
-			return nil, err
-		}
-
-		offs := offset + (uint64(i) * subCount)
-
-		cs, err := diffNode(ctx, prevSubCtx, curSubCtx, prevSubn, curSubn, offs)
-		if err != nil {
-			return nil, err
-		}
-
-		changes = append(changes, cs...)
+		return diffLeaves(prevn, curn, offset, v)
 	}
 
-	return changes, nil
-}
-
-func addAll(ctx context.Context, nc *nodeContext, node *node, offset uint64) ([]*Change, error) {
-	var changes []*Change
-	err := node.forEachAt(ctx, nc.bs, nc.bitWidth, nc.height, 0, offset, func(index uint64, deferred *cbg.Deferred) error {
-		changes = append(changes, &Change{
-			Type:   Add,
-			Key:    index,
-			Before: nil,
-			After:  deferred,
-		})
-
-		return nil
-	})
-	if err != nil {
-		return nil, err
+	bitWidth := prev.nc.bitWidth
+	prevSubs, err := prev.children(ctx, h, offset, bitWidth)
+	if err != nil || prevSubs == nil {
+		return err
 	}
-
-	return changes, nil
-}
-
-func removeAll(ctx context.Context, nc *nodeContext, node *node, offset uint64) ([]*Change, error) {
-	var changes []*Change
-
-	err := node.forEachAt(ctx, nc.bs, nc.bitWidth, nc.height, 0, offset, func(index uint64, deferred *cbg.Deferred) error {
-		changes = append(changes, &Change{
-			Type:   Remove,
-			Key:    index,
-			Before: deferred,
-			After:  nil,
-		})
-
-		return nil
-	})
-	if err != nil {
-		return nil, err
+	curSubs, err := cur.children(ctx, h, offset, bitWidth)
+	if err != nil || curSubs == nil {
+		return err
 	}
-
-	return changes, nil
+	subCount := nodesForHeight(bitWidth, h)
+	for i := range prevSubs {
+		if err := diffAt(ctx, h-1, offset+(uint64(i)*subCount), prevSubs[i], curSubs[i], v); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func diffLeaves(prev, cur *node, offset uint64) ([]*Change, error) {
+func diffLeaves(prev, cur *node, offset uint64, v diffVisitor) error {
 	if len(prev.values) != len(cur.values) {
-		return nil, fmt.Errorf("node leaves have different numbers of values (prev=%d, cur=%d)", len(prev.values), len(cur.values))
+		return malformedf("node leaves have different numbers of values (prev=%d, cur=%d)", len(prev.values), len(cur.values))
 	}
 
-	var changes []*Change
 	for i, prevVal := range prev.values {
 		index := offset + uint64(i)
 
@@ -356,37 +337,28 @@ func diffLeaves(prev, cur *node, offset uint64) ([]*Change, error) {
 		}
 
 		if prevVal == nil && curVal != nil {
-			changes = append(changes, &Change{
-				Type:   Add,
-				Key:    index,
-				Before: nil,
-				After:  curVal,
-			})
+			if err := v.change(Add, index, nil, curVal); err != nil {
+				return err
+			}
 
 			continue
 		}
 
 		if prevVal != nil && curVal == nil {
-			changes = append(changes, &Change{
-				Type:   Remove,
-				Key:    index,
-				Before: prevVal,
-				After:  nil,
-			})
+			if err := v.change(Remove, index, prevVal, nil); err != nil {
+				return err
+			}
 
 			continue
 		}
 
 		if !bytes.Equal(prevVal.Raw, curVal.Raw) {
-			changes = append(changes, &Change{
-				Type:   Modify,
-				Key:    index,
-				Before: prevVal,
-				After:  curVal,
-			})
+			if err := v.change(Modify, index, prevVal, curVal); err != nil {
+				return err
+			}
 		}
 
 	}
 
-	return changes, nil
+	return nil
 }
@@ -0,0 +1,123 @@
+package amt
+
+import (
+	"context"
+
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+// ChangedKeys lists the indexes that differ between two AMTs, grouped by the
+// type of change. Each list is in ascending order.
+type ChangedKeys struct {
+	Added    []uint64
+	Removed  []uint64
+	Modified []uint64
+}
+
+// ChangeStats counts the changes between two AMTs by type.
+type ChangeStats struct {
+	Added    uint64
+	Removed  uint64
+	Modified uint64
+}
+
+// DiffKeys returns the indexes that differ between prev and cur, without
+// their values. Subtrees that only exist on one side are walked without
+// decoding the values they hold. opts are applied to both prev and cur.
+func DiffKeys(ctx context.Context, prevBs, curBs cbor.IpldStore, prev, cur cid.Cid, opts ...Option) (*ChangedKeys, error) {
+	var keys ChangedKeys
+	err := diff(ctx, prevBs, curBs, prev, cur, keyVisitor(func(typ ChangeType, key uint64) error {
+		switch typ {
+		case Add:
+			keys.Added = append(keys.Added, key)
+		case Remove:
+			keys.Removed = append(keys.Removed, key)
+		case Modify:
+			keys.Modified = append(keys.Modified, key)
+		}
+		return nil
+	}), opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &keys, nil
+}
+
+// DiffStats counts the changes between prev and cur by type. Like DiffKeys, it
+// doesn't decode the values of subtrees that only exist on one side. opts are
+// applied to both prev and cur.
+func DiffStats(ctx context.Context, prevBs, curBs cbor.IpldStore, prev, cur cid.Cid, opts ...Option) (*ChangeStats, error) {
+	var stats ChangeStats
+	err := diff(ctx, prevBs, curBs, prev, cur, keyVisitor(func(typ ChangeType, _ uint64) error {
+		switch typ {
+		case Add:
+			stats.Added++
+		case Remove:
+			stats.Removed++
+		case Modify:
+			stats.Modified++
+		}
+		return nil
+	}), opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// keyVisitor is a diffVisitor that only reports the type and index of each
+// change.
+type keyVisitor func(typ ChangeType, key uint64) error
+
+func (kv keyVisitor) subtree(ctx context.Context, typ ChangeType, nc *nodeContext, ln *link, offset uint64) error {
+	return forEachKey(ctx, nc, ln, offset, func(key uint64) error {
+		return kv(typ, key)
+	})
+}
+
+func (kv keyVisitor) nodes(_, _ *link) error {
+	return nil
+}
+
+func (kv keyVisitor) change(typ ChangeType, key uint64, _, _ *cbg.Deferred) error {
+	return kv(typ, key)
+}
+
+// forEachKey calls cb with each index set in the subtree behind ln, in
+// ascending order. Nodes that aren't already cached are loaded with
+// loadShallow, so values are never decoded.
+func forEachKey(ctx context.Context, nc *nodeContext, ln *link, offset uint64, cb func(uint64) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	n, err := ln.loadShallow(ctx, nc.bs, nc.bitWidth, nc.height)
+	if err != nil {
+		return err
+	}
+
+	if nc.height == 0 {
+		for i, v := range n.values {
+			if v == nil {
+				continue
+			}
+			if err := cb(offset + uint64(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	subCount := nc.nodesAtHeight()
+	subCtx := nc.child()
+	for i, sub := range n.links {
+		if sub == nil {
+			continue
+		}
+		if err := forEachKey(ctx, subCtx, sub, offset+(uint64(i)*subCount), cb); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package amt
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"testing"
+
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffKeys(t *testing.T) {
+	runTestWithBitWidths(t, bitWidths2to18, func(t *testing.T, opts ...Option) {
+		prevBs := cbor.NewCborStore(newMockBlocks())
+		curBs := cbor.NewCborStore(newMockBlocks())
+		ctx := context.Background()
+
+		a, err := NewAMT(prevBs, opts...)
+		require.NoError(t, err)
+		b, err := NewAMT(curBs, opts...)
+		require.NoError(t, err)
+
+		for i := 0; i < 100; i++ {
+			assertSet(t, a, uint64(i), "foo"+strconv.Itoa(i))
+		}
+		for i := 0; i < 100; i += 2 {
+			assertSet(t, b, uint64(i), "bar"+strconv.Itoa(i))
+		}
+		for i := 2000; i < 2500; i++ {
+			assertSet(t, b, uint64(i), "bar"+strconv.Itoa(i))
+		}
+		for i := 10000; i < 10250; i++ {
+			assertSet(t, a, uint64(i), "foo"+strconv.Itoa(i))
+		}
+
+		aCid, err := a.Flush(ctx)
+		require.NoError(t, err)
+		bCid, err := b.Flush(ctx)
+		require.NoError(t, err)
+
+		changes, err := Diff(ctx, prevBs, curBs, aCid, bCid, opts...)
+		require.NoError(t, err)
+
+		var expected ChangedKeys
+		for _, c := range changes {
+			switch c.Type {
+			case Add:
+				expected.Added = append(expected.Added, c.Key)
+			case Remove:
+				expected.Removed = append(expected.Removed, c.Key)
+			case Modify:
+				expected.Modified = append(expected.Modified, c.Key)
+			}
+		}
+		for _, keys := range [][]uint64{expected.Added, expected.Removed, expected.Modified} {
+			sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+		}
+
+		keys, err := DiffKeys(ctx, prevBs, curBs, aCid, bCid, opts...)
+		require.NoError(t, err)
+		require.Equal(t, &expected, keys)
+
+		stats, err := DiffStats(ctx, prevBs, curBs, aCid, bCid, opts...)
+		require.NoError(t, err)
+		require.Equal(t, &ChangeStats{Added: 500, Removed: 300, Modified: 50}, stats)
+
+		// and in the other direction, including from an empty AMT
+		stats, err = DiffStats(ctx, curBs, prevBs, bCid, aCid, opts...)
+		require.NoError(t, err)
+		require.Equal(t, &ChangeStats{Added: 300, Removed: 500, Modified: 50}, stats)
+
+		empty, err := NewAMT(prevBs, opts...)
+		require.NoError(t, err)
+		emptyCid, err := empty.Flush(ctx)
+		require.NoError(t, err)
+		keys, err = DiffKeys(ctx, prevBs, prevBs, emptyCid, aCid, opts...)
+		require.NoError(t, err)
+		require.Len(t, keys.Added, 350)
+		require.Empty(t, keys.Removed)
+		require.Empty(t, keys.Modified)
+	})
+}
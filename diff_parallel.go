@@ -3,7 +3,6 @@ package amt
 import (
 	"bytes"
 	"context"
-	"fmt"
 	"sync"
 
 	"github.com/ipfs/go-cid"
@@ -13,14 +12,22 @@ import (
 	"golang.org/x/xerrors"
 )
 
-func ParallelDiff(ctx context.Context, prevBs, curBs cbor.IpldStore, prev, cur cid.Cid, workers int64, opts ...Option) ([]*Change, error) {
+func ParallelDiff(ctx context.Context, prevBs, curBs cbor.IpldStore, prev, cur cid.Cid, workers int64, opts ...Option) (_ []*Change, err error) {
+	ctx, sp, opts, err := startDiffSpan(ctx, "ParallelDiff", opts)
+	if err != nil {
+		return nil, err
+	}
+	if sp != nil {
+		defer func() { sp.end(err) }()
+	}
+
 	prevAmt, err := LoadAMT(ctx, prevBs, prev, opts...)
 	if err != nil {
 		return nil, xerrors.Errorf("loading previous root: %w", err)
 	}
 
 	prevCtx := &nodeContext{
-		bs:       prevBs,
+		bs:       prevAmt.store,
 		bitWidth: prevAmt.bitWidth,
 		height:   prevAmt.height,
 	}
@@ -32,21 +39,29 @@ func ParallelDiff(ctx context.Context, prevBs, curBs cbor.IpldStore, prev, cur c
 
 	// TODO: remove when https://github.com/filecoin-project/go-amt-ipld/issues/54 is closed.
 	if curAmt.bitWidth != prevAmt.bitWidth {
-		return nil, xerrors.Errorf("diffing AMTs with differing bitWidths not supported (prev=%d, cur=%d)", prevAmt.bitWidth, curAmt.bitWidth)
+		return nil, xerrors.Errorf("%w: diffing AMTs with differing bitWidths not supported (prev=%d, cur=%d)", ErrBitWidthMismatch, prevAmt.bitWidth, curAmt.bitWidth)
 	}
 
 	curCtx := &nodeContext{
-		bs:       curBs,
+		bs:       curAmt.store,
 		bitWidth: curAmt.bitWidth,
 		height:   curAmt.height,
 	}
 
 	// edge case of diffing an empty AMT against non-empty
 	if prevAmt.count == 0 && curAmt.count != 0 {
-		return addAll(ctx, curCtx, curAmt.node, 0)
+		var cc changeCollector
+		if err := cc.subtree(ctx, Add, curCtx, &link{cached: curAmt.node}, 0); err != nil {
+			return nil, err
+		}
+		return cc.changes, nil
 	}
 	if prevAmt.count != 0 && curAmt.count == 0 {
-		return removeAll(ctx, prevCtx, prevAmt.node, 0)
+		var cc changeCollector
+		if err := cc.subtree(ctx, Remove, prevCtx, &link{cached: prevAmt.node}, 0); err != nil {
+			return nil, err
+		}
+		return cc.changes, nil
 	}
 	out := make(chan *Change)
 	differ, ctx := newDiffScheduler(ctx, workers, &task{
@@ -100,7 +115,7 @@ func parallelRemoveAll(ctx context.Context, nc *nodeContext, node *node, offset
 
 func parallelDiffLeaves(prev, cur *node, offset uint64, out chan *Change) error {
 	if len(prev.values) != len(cur.values) {
-		return fmt.Errorf("node leaves have different numbers of values (prev=%d, cur=%d)", len(prev.values), len(cur.values))
+		return malformedf("node leaves have different numbers of values (prev=%d, cur=%d)", len(prev.values), len(cur.values))
 	}
 
 	for i, prevVal := range prev.values {
@@ -189,6 +204,11 @@ func (s *diffScheduler) startScheduler(ctx context.Context) {
 			for range s.out {
 				s.taskWg.Done()
 			}
+			// Because tasks may have been left on the stack when returning early.
+			for range s.stack {
+				s.taskWg.Done()
+			}
+			s.stack = nil
 			// Because the workers may have enqueued additional tasks.
 			for range s.in {
 				s.taskWg.Done()
@@ -243,6 +263,9 @@ func (s *diffScheduler) startWorkers(ctx context.Context, out chan *Change) {
 
 func (s *diffScheduler) work(ctx context.Context, todo *task, results chan *Change) error {
 	defer s.taskWg.Done()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
 	prev := todo.prev
 	prevCtx := todo.prevCtx
@@ -345,15 +368,15 @@ func (s *diffScheduler) work(ctx context.Context, todo *task, results chan *Chan
 
 	// sanity check
 	if prevCtx.height != curCtx.height {
-		return fmt.Errorf("comparing non-leaf nodes of unequal heights (%d, %d)", prevCtx.height, curCtx.height)
+		return malformedf("comparing non-leaf nodes of unequal heights (%d, %d)", prevCtx.height, curCtx.height)
 	}
 
 	if len(prev.links) != len(cur.links) {
-		return fmt.Errorf("nodes have different numbers of links (prev=%d, cur=%d)", len(prev.links), len(cur.links))
+		return malformedf("nodes have different numbers of links (prev=%d, cur=%d)", len(prev.links), len(cur.links))
 	}
 
 	if prev.links == nil || cur.links == nil {
-		return fmt.Errorf("nodes have no links")
+		return malformedf("nodes have no links")
 	}
 
 	subCount := prevCtx.nodesAtHeight()
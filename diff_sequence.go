@@ -0,0 +1,200 @@
+package amt
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-amt-ipld/v4/internal"
+)
+
+// diffSequenceWindow is the maximum number of DiffSequence steps that are
+// being diffed, or whose changes are waiting to be delivered, at once.
+const diffSequenceWindow = 4
+
+// DiffSequence diffs each consecutive pair of roots, calling cb with each
+// change that transforms roots[step] into roots[step+1]. The changes for each
+// step are the same as those returned by Diff, and are delivered in step
+// order. opts are applied to every root.
+//
+// Every root other than the first and last takes part in two steps, so nodes
+// decoded for one step are kept for use by the next rather than being loaded
+// and decoded again. Up to a few steps are diffed concurrently, ahead of the
+// step being delivered.
+func DiffSequence(ctx context.Context, bs cbor.IpldStore, roots []cid.Cid, cb func(step int, ch *Change) error, opts ...Option) error {
+	if len(roots) < 2 {
+		return nil
+	}
+	steps := len(roots) - 1
+
+	cache := &sequenceCache{
+		store:   bs,
+		entries: make(map[cid.Cid]*sequenceEntry),
+	}
+	results := make([]chan []*Change, steps)
+	for i := range results {
+		results[i] = make(chan []*Change, 1)
+	}
+	window := make(chan struct{}, diffSequenceWindow)
+
+	grp, ctx := errgroup.WithContext(ctx)
+	grp.Go(func() error {
+		for step := 0; step < steps; step++ {
+			select {
+			case window <- struct{}{}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+
+			step := step
+			grp.Go(func() error {
+				stepBs := &sequenceStore{cache: cache, step: step}
+				var cc changeCollector
+				if err := diff(ctx, stepBs, stepBs, roots[step], roots[step+1], &cc, opts...); err != nil {
+					return xerrors.Errorf("diffing step %d: %w", step, err)
+				}
+				results[step] <- cc.changes
+				return nil
+			})
+		}
+		return nil
+	})
+	grp.Go(func() error {
+		for step := 0; step < steps; step++ {
+			var changes []*Change
+			select {
+			case changes = <-results[step]:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+
+			for _, ch := range changes {
+				if err := cb(step, ch); err != nil {
+					return err
+				}
+			}
+
+			// Nodes that weren't used by this step can only belong to earlier
+			// roots, which later steps won't load.
+			cache.evictBefore(step)
+			<-window
+		}
+		return nil
+	})
+	return grp.Wait()
+}
+
+// sequenceCache holds the roots and nodes loaded by the steps of a
+// DiffSequence, so that a step can reuse those loaded by the step before. They
+// are held decoded, or serialized where options make the AMT read its blocks
+// raw, see amtStore.
+type sequenceCache struct {
+	store cbor.IpldStore
+
+	lk      sync.Mutex
+	entries map[cid.Cid]*sequenceEntry
+}
+
+type sequenceEntry struct {
+	value    any // internal.Root, internal.Node or rawBlock
+	lastStep int
+}
+
+func (sc *sequenceCache) lookup(c cid.Cid, step int) (any, bool) {
+	sc.lk.Lock()
+	defer sc.lk.Unlock()
+	e, ok := sc.entries[c]
+	if !ok {
+		return nil, false
+	}
+	if step > e.lastStep {
+		e.lastStep = step
+	}
+	return e.value, true
+}
+
+func (sc *sequenceCache) add(c cid.Cid, step int, value any) {
+	sc.lk.Lock()
+	defer sc.lk.Unlock()
+	if e, ok := sc.entries[c]; ok {
+		if step > e.lastStep {
+			e.lastStep = step
+		}
+		return
+	}
+	sc.entries[c] = &sequenceEntry{value: value, lastStep: step}
+}
+
+// evictBefore drops the entries that were last used before the given step.
+func (sc *sequenceCache) evictBefore(step int) {
+	sc.lk.Lock()
+	defer sc.lk.Unlock()
+	for c, e := range sc.entries {
+		if e.lastStep < step {
+			delete(sc.entries, c)
+		}
+	}
+}
+
+// sequenceStore is the view of a sequenceCache used by a single step. Roots,
+// nodes and raw blocks are served from the cache where possible, other values
+// pass straight through to the underlying store.
+type sequenceStore struct {
+	cache *sequenceCache
+	step  int
+}
+
+var _ cbor.IpldStore = (*sequenceStore)(nil)
+
+func (ss *sequenceStore) Get(ctx context.Context, c cid.Cid, out interface{}) error {
+	switch out := out.(type) {
+	case *internal.Root:
+		if v, ok := ss.cache.lookup(c, ss.step); ok {
+			if r, ok := v.(internal.Root); ok {
+				*out = r
+				return nil
+			}
+		}
+		if err := ss.cache.store.Get(ctx, c, out); err != nil {
+			return err
+		}
+		ss.cache.add(c, ss.step, *out)
+		return nil
+	case *internal.Node:
+		if v, ok := ss.cache.lookup(c, ss.step); ok {
+			if nd, ok := v.(internal.Node); ok {
+				// decoded nodes are never modified, so can be shared
+				*out = nd
+				return nil
+			}
+		}
+		if err := ss.cache.store.Get(ctx, c, out); err != nil {
+			return err
+		}
+		ss.cache.add(c, ss.step, *out)
+		return nil
+	case *rawBlock:
+		if v, ok := ss.cache.lookup(c, ss.step); ok {
+			if b, ok := v.(rawBlock); ok {
+				// the data of a raw block is never modified either
+				*out = b
+				return nil
+			}
+		}
+		if err := ss.cache.store.Get(ctx, c, out); err != nil {
+			return err
+		}
+		ss.cache.add(c, ss.step, *out)
+		return nil
+	default:
+		return ss.cache.store.Get(ctx, c, out)
+	}
+}
+
+func (ss *sequenceStore) Put(ctx context.Context, v interface{}) (cid.Cid, error) {
+	return ss.cache.store.Put(ctx, v)
+}
@@ -0,0 +1,79 @@
+package amt
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffSequence(t *testing.T) {
+	ctx := context.Background()
+	mock := newMockBlocks()
+	bs := cbor.NewCborStore(mock)
+	rnd := rand.New(rand.NewSource(1))
+
+	a, err := NewAMT(bs)
+	require.NoError(t, err)
+	var roots []cid.Cid
+	for epoch := 0; epoch < 30; epoch++ {
+		for i := 0; i < 20; i++ {
+			k := uint64(rnd.Intn(5000))
+			if rnd.Intn(4) == 0 {
+				_, err := a.Delete(ctx, k)
+				require.NoError(t, err)
+			} else {
+				assertSet(t, a, k, string(rune('a'+epoch)))
+			}
+		}
+		c, err := a.Flush(ctx)
+		require.NoError(t, err)
+		roots = append(roots, c)
+	}
+
+	mock.getCount = 0
+	expected := make([][]*Change, len(roots)-1)
+	for step := range expected {
+		expected[step], err = Diff(ctx, bs, bs, roots[step], roots[step+1])
+		require.NoError(t, err)
+	}
+	pairwiseGets := mock.getCount
+
+	mock.getCount = 0
+	actual := make([][]*Change, len(roots)-1)
+	var steps []int
+	err = DiffSequence(ctx, bs, roots, func(step int, ch *Change) error {
+		steps = append(steps, step)
+		actual[step] = append(actual[step], ch)
+		return nil
+	})
+	require.NoError(t, err)
+	require.IsNonDecreasing(t, steps)
+	require.Equal(t, expected, actual)
+	require.Less(t, mock.getCount, pairwiseGets)
+
+	// nodes are still shared where options make the AMT read blocks raw
+	mock.getCount = 0
+	actual = make([][]*Change, len(roots)-1)
+	err = DiffSequence(ctx, bs, roots, func(step int, ch *Change) error {
+		actual[step] = append(actual[step], ch)
+		return nil
+	}, MaxHeight(64))
+	require.NoError(t, err)
+	require.Equal(t, expected, actual)
+	require.Less(t, mock.getCount, pairwiseGets)
+
+	// errors from the callback stop the sequence
+	stop := errors.New("stop")
+	err = DiffSequence(ctx, bs, roots, func(step int, ch *Change) error {
+		if step == 3 {
+			return stop
+		}
+		return nil
+	})
+	require.ErrorIs(t, err, stop)
+}
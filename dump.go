@@ -0,0 +1,330 @@
+package amt
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
+	cbg "github.com/whyrusleeping/cbor-gen"
+
+	"github.com/filecoin-project/go-amt-ipld/v4/internal"
+)
+
+// DumpFormat selects the output of Root.Dump.
+type DumpFormat int
+
+const (
+	// DumpText writes one line per node, indented by depth, with the values
+	// of each leaf on the lines that follow it.
+	DumpText DumpFormat = iota
+	// DumpDOT writes a Graphviz digraph with a box per node, labelled with
+	// the node's description and, for leaves, its values.
+	DumpDOT
+)
+
+type dumpConfig struct {
+	maxDepth   int
+	start, end uint64
+	hexValues  bool
+}
+
+// DumpOption configures Root.Dump.
+type DumpOption func(*dumpConfig) error
+
+// DumpMaxDepth limits the dump to nodes at most depth links below the root,
+// so 0 only dumps the root node. Links below that depth are counted, as
+// hidden, but not followed.
+func DumpMaxDepth(depth int) DumpOption {
+	return func(dc *dumpConfig) error {
+		if depth < 0 {
+			return fmt.Errorf("dump depth %d is negative", depth)
+		}
+		dc.maxDepth = depth
+		return nil
+	}
+}
+
+// DumpRange limits the dump to the nodes and values covering indexes in
+// [start, end).
+func DumpRange(start, end uint64) DumpOption {
+	return func(dc *dumpConfig) error {
+		if start >= end {
+			return fmt.Errorf("dump range [%d, %d) is empty", start, end)
+		}
+		dc.start, dc.end = start, end
+		return nil
+	}
+}
+
+// DumpHexValues writes values as hex rather than in CBOR diagnostic notation.
+func DumpHexValues() DumpOption {
+	return func(dc *dumpConfig) error {
+		dc.hexValues = true
+		return nil
+	}
+}
+
+// Dump writes a description of the AMT's structure to w, for debugging. Each
+// node is described by its height, the range of indexes it covers, the bits of
+// its bitmap (in slot order, or as a list of set slots for bitwidths over 6),
+// the end of its CID and whether it is dirty, cached or only stored. Leaves
+// also list their values, in CBOR diagnostic notation unless DumpHexValues is
+// given.
+//
+// Unflushed changes are included, and nodes that aren't already cached are
+// loaded for the dump without being cached.
+func (r *Root) Dump(ctx context.Context, w io.Writer, format DumpFormat, opts ...DumpOption) error {
+	dc := &dumpConfig{maxDepth: -1, end: MaxIndex + 1}
+	for _, opt := range opts {
+		if err := opt(dc); err != nil {
+			return err
+		}
+	}
+
+	var f dumpFormatter
+	switch format {
+	case DumpText:
+		f = &textDump{w: w}
+	case DumpDOT:
+		f = &dotDump{w: w}
+	default:
+		return fmt.Errorf("unknown dump format %d", format)
+	}
+
+	d := &dumper{root: r, cfg: dc, out: f}
+	if err := f.begin(r); err != nil {
+		return err
+	}
+	if err := d.visit(ctx, r.node, nil, r.height, 0, 0, -1, 0); err != nil {
+		return err
+	}
+	return f.end()
+}
+
+// dumpNode is the description of a single node passed to a dumpFormatter.
+type dumpNode struct {
+	id, parent, slot int
+	depth, height    int
+	start, end       uint64
+	bits             string
+	cid, state       string
+	values           []string
+	hidden           int
+}
+
+func (dn *dumpNode) describe() string {
+	var b strings.Builder
+	if dn.height == 0 {
+		b.WriteString("leaf")
+	} else {
+		fmt.Fprintf(&b, "height=%d", dn.height)
+	}
+	fmt.Fprintf(&b, " [%d, %d) bits=%s", dn.start, dn.end, dn.bits)
+	if dn.cid != "" {
+		fmt.Fprintf(&b, " cid=%s", dn.cid)
+	}
+	b.WriteString(" " + dn.state)
+	if dn.hidden > 0 {
+		fmt.Fprintf(&b, " hidden=%d", dn.hidden)
+	}
+	return b.String()
+}
+
+type dumpFormatter interface {
+	begin(r *Root) error
+	node(dn *dumpNode) error
+	end() error
+}
+
+type dumper struct {
+	root   *Root
+	cfg    *dumpConfig
+	out    dumpFormatter
+	nextID int
+}
+
+func (d *dumper) visit(ctx context.Context, n *node, ln *link, height, depth int, offset uint64, parent, slot int) error {
+	bitWidth := d.root.bitWidth
+	dn := &dumpNode{
+		id:     d.nextID,
+		parent: parent,
+		slot:   slot,
+		depth:  depth,
+		height: height,
+		start:  offset,
+		end:    spanEnd(offset, nodesForHeight(bitWidth, height+1)),
+		bits:   n.bits(bitWidth),
+	}
+	d.nextID++
+	switch {
+	case ln == nil:
+		dn.state = "root"
+	case ln.dirty:
+		dn.state = "dirty"
+	default:
+		s := ln.cid.String()
+		if len(s) > 8 {
+			s = "…" + s[len(s)-8:]
+		}
+		dn.cid = s
+		if ln.cached != nil {
+			dn.state = "cached"
+		} else {
+			dn.state = "stored"
+		}
+	}
+
+	if height == 0 {
+		for i, v := range n.values {
+			idx := offset + uint64(i)
+			if v == nil || idx < d.cfg.start || idx >= d.cfg.end {
+				continue
+			}
+			dn.values = append(dn.values, fmt.Sprintf("%d = %s", idx, d.value(v)))
+		}
+		return d.out.node(dn)
+	}
+
+	type child struct {
+		slot   int
+		ln     *link
+		offset uint64
+	}
+	var children []child
+	subCount := nodesForHeight(bitWidth, height)
+	for i, sub := range n.links {
+		if sub == nil {
+			continue
+		}
+		offs := offset + uint64(i)*subCount
+		if offs >= d.cfg.end || spanEnd(offs, subCount) <= d.cfg.start {
+			continue
+		}
+		if d.cfg.maxDepth >= 0 && depth >= d.cfg.maxDepth {
+			dn.hidden++
+			continue
+		}
+		children = append(children, child{slot: i, ln: sub, offset: offs})
+	}
+	if err := d.out.node(dn); err != nil {
+		return err
+	}
+
+	for _, c := range children {
+		subn, err := c.ln.peek(ctx, d.root.store, bitWidth, height-1)
+		if err != nil {
+			return err
+		}
+		if err := d.visit(ctx, subn, c.ln, height-1, depth+1, c.offset, dn.id, c.slot); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *dumper) value(v *cbg.Deferred) string {
+	if !d.cfg.hexValues {
+		if s, err := internal.Diagnostic(v.Raw); err == nil {
+			return s
+		}
+	}
+	return hex.EncodeToString(v.Raw)
+}
+
+// bits renders which slots of the node are set, as a string of bits in slot
+// order for bitwidths up to 6, and as a list of the set slots above that.
+func (n *node) bits(bitWidth uint) string {
+	width := 1 << bitWidth
+	set := func(i int) bool {
+		if i < len(n.links) && n.links[i] != nil {
+			return true
+		}
+		return i < len(n.values) && n.values[i] != nil
+	}
+
+	var b strings.Builder
+	if width <= 64 {
+		for i := 0; i < width; i++ {
+			if set(i) {
+				b.WriteByte('1')
+			} else {
+				b.WriteByte('0')
+			}
+		}
+		return b.String()
+	}
+	b.WriteByte('{')
+	for i := 0; i < width; i++ {
+		if !set(i) {
+			continue
+		}
+		if b.Len() > 1 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%d", i)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+type textDump struct {
+	w io.Writer
+}
+
+func (td *textDump) begin(r *Root) error {
+	_, err := fmt.Fprintf(td.w, "amt bitwidth=%d height=%d count=%d\n", r.bitWidth, r.height, r.count)
+	return err
+}
+
+func (td *textDump) node(dn *dumpNode) error {
+	var b strings.Builder
+	indent := strings.Repeat("  ", dn.depth)
+	b.WriteString(indent)
+	if dn.parent >= 0 {
+		fmt.Fprintf(&b, "%d: ", dn.slot)
+	}
+	b.WriteString(dn.describe() + "\n")
+	for _, v := range dn.values {
+		b.WriteString(indent + "  " + v + "\n")
+	}
+	_, err := io.WriteString(td.w, b.String())
+	return err
+}
+
+func (td *textDump) end() error {
+	return nil
+}
+
+type dotDump struct {
+	w io.Writer
+}
+
+func (dd *dotDump) begin(r *Root) error {
+	_, err := fmt.Fprintf(dd.w, "digraph amt {\n\tlabel=%s;\n\tnode [shape=box, fontname=\"monospace\"];\n",
+		dotQuote(fmt.Sprintf("amt bitwidth=%d height=%d count=%d", r.bitWidth, r.height, r.count)))
+	return err
+}
+
+func (dd *dotDump) node(dn *dumpNode) error {
+	lines := append([]string{dn.describe()}, dn.values...)
+	var b strings.Builder
+	fmt.Fprintf(&b, "\tn%d [label=%s];\n", dn.id, dotQuote(strings.Join(lines, "\n")+"\n"))
+	if dn.parent >= 0 {
+		fmt.Fprintf(&b, "\tn%d -> n%d [label=\"%d\"];\n", dn.parent, dn.id, dn.slot)
+	}
+	_, err := io.WriteString(dd.w, b.String())
+	return err
+}
+
+func (dd *dotDump) end() error {
+	_, err := io.WriteString(dd.w, "}\n")
+	return err
+}
+
+// dotQuote quotes s as a DOT string, with each line left-justified.
+func dotQuote(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\l`).Replace(s)
+	return `"` + s + `"`
+}
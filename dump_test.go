@@ -0,0 +1,111 @@
+package amt
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/stretchr/testify/require"
+	cbg "github.com/whyrusleeping/cbor-gen"
+
+	"github.com/filecoin-project/go-amt-ipld/v4/internal"
+)
+
+func TestDump(t *testing.T) {
+	ctx := context.Background()
+	bs := cbor.NewCborStore(newMockBlocks())
+
+	a, err := NewAMT(bs, UseTreeBitWidth(2))
+	require.NoError(t, err)
+	for _, i := range []uint64{0, 1, 5, 20} {
+		assertSet(t, a, i, "v")
+	}
+	c, err := a.Flush(ctx)
+	require.NoError(t, err)
+
+	b, err := LoadAMT(ctx, bs, c, UseTreeBitWidth(2))
+	require.NoError(t, err)
+	assertSet(t, b, 7, "new")
+
+	var buf bytes.Buffer
+	require.NoError(t, b.Dump(ctx, &buf, DumpText))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Equal(t, "amt bitwidth=2 height=2 count=5", lines[0])
+	require.Equal(t, "height=2 [0, 64) bits=1100 root", lines[1])
+	require.Equal(t, "  0: height=1 [0, 16) bits=1100 dirty", lines[2])
+	require.Regexp(t, `^    0: leaf \[0, 4\) bits=1100 cid=…\w{8} stored$`, lines[3])
+	require.Equal(t, "      0 = h'76'", lines[4])
+	require.Equal(t, "      7 = h'6e6577'", lines[8])
+	require.Len(t, lines, 12)
+
+	// the dump doesn't cache the nodes it loads
+	require.Nil(t, b.node.links[1].cached)
+
+	buf.Reset()
+	require.NoError(t, b.Dump(ctx, &buf, DumpText, DumpRange(4, 8), DumpHexValues()))
+	require.Equal(t, strings.Join([]string{
+		"amt bitwidth=2 height=2 count=5",
+		"height=2 [0, 64) bits=1100 root",
+		"  0: height=1 [0, 16) bits=1100 dirty",
+		"    1: leaf [4, 8) bits=0101 dirty",
+		"      5 = 4176",
+		"      7 = 436e6577",
+	}, "\n")+"\n", buf.String())
+
+	buf.Reset()
+	require.NoError(t, b.Dump(ctx, &buf, DumpDOT, DumpMaxDepth(1)))
+	out := buf.String()
+	require.True(t, strings.HasPrefix(out, "digraph amt {\n"))
+	require.True(t, strings.HasSuffix(out, "}\n"))
+	require.Contains(t, out, `n1 [label="height=1 [0, 16) bits=1100 dirty hidden=2\l"];`)
+	require.Contains(t, out, `n0 -> n2 [label="1"];`)
+
+	require.Error(t, b.Dump(ctx, &buf, DumpText, DumpRange(5, 5)))
+	require.Error(t, b.Dump(ctx, &buf, DumpFormat(7)))
+}
+
+func TestDiagnostic(t *testing.T) {
+	target, err := cbor.NewCborStore(newMockBlocks()).Put(context.Background(), cborstr("target"))
+	require.NoError(t, err)
+	link := cbg.CborCid(target)
+	var linkBuf bytes.Buffer
+	require.NoError(t, link.MarshalCBOR(&linkBuf))
+
+	for _, tc := range []struct {
+		hex, diag string
+	}{
+		{"00", "0"},
+		{"20", "-1"},
+		{"1903e8", "1000"},
+		{"4401020304", "h'01020304'"},
+		{"6449455446", `"IETF"`},
+		{"83010203", "[1, 2, 3]"},
+		{"a26161016162820203", `{"a": 1, "b": [2, 3]}`},
+		{"f4", "false"},
+		{"f6", "null"},
+		{"f93c00", "1.0"},
+		{"fb3ff199999999999a", "1.1"},
+		{"c11a514b67b0", "1(1363896240)"},
+	} {
+		data, err := hex.DecodeString(tc.hex)
+		require.NoError(t, err)
+		diag, err := internal.Diagnostic(data)
+		require.NoError(t, err, tc.hex)
+		require.Equal(t, tc.diag, diag)
+	}
+
+	diag, err := internal.Diagnostic(linkBuf.Bytes())
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(diag, "42(h'00"))
+	require.True(t, strings.HasSuffix(diag, ") /"+target.String()+"/"))
+
+	for _, bad := range []string{"", "18", "8201", "0000", "9f01ff"} {
+		data, err := hex.DecodeString(bad)
+		require.NoError(t, err)
+		_, err = internal.Diagnostic(data)
+		require.Error(t, err, bad)
+	}
+}
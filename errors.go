@@ -0,0 +1,108 @@
+package amt
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"golang.org/x/xerrors"
+)
+
+var (
+	// ErrMalformed is matched by the errors returned where the blocks of an
+	// AMT don't describe a valid AMT, e.g. because they are corrupt or were
+	// written by faulty code. Such errors are a *MalformedError, so errors.As
+	// can be used for the block at fault.
+	ErrMalformed = errors.New("malformed amt")
+	// ErrIndexOutOfRange is matched by the errors returned for indexes greater
+	// than MaxIndex.
+	ErrIndexOutOfRange = errors.New("index is out of range for the amt")
+	// ErrBitWidthMismatch is matched by the errors returned where an AMT
+	// doesn't have the bit width given with UseTreeBitWidth, or where AMTs
+	// with differing bit widths are compared.
+	ErrBitWidthMismatch = errors.New("amt bitwidth mismatch")
+	// ErrNoValues is returned by FirstSetIndex on an empty AMT.
+	ErrNoValues = errors.New("no values")
+	// ErrNotFound is matched by the errors returned where an index must be
+	// set but isn't, by BatchDelete in strict mode and by Prove.
+	ErrNotFound = errors.New("index is not set in the amt")
+)
+
+// MalformedError describes why a block of an AMT is malformed. It matches
+// ErrMalformed.
+type MalformedError struct {
+	// Cid is the CID of the block at fault, cid.Undef where it isn't known,
+	// e.g. for a root that isn't yet flushed.
+	Cid cid.Cid
+	// Height is the height of the node at fault, or -1 where it isn't known.
+	Height int
+	// Err describes what is wrong.
+	Err error
+}
+
+func (e *MalformedError) Error() string {
+	switch {
+	case e.Cid.Defined() && e.Height >= 0:
+		return fmt.Sprintf("malformed amt block %s at height %d: %s", e.Cid, e.Height, e.Err)
+	case e.Cid.Defined():
+		return fmt.Sprintf("malformed amt block %s: %s", e.Cid, e.Err)
+	case e.Height >= 0:
+		return fmt.Sprintf("malformed amt node at height %d: %s", e.Height, e.Err)
+	}
+	return fmt.Sprintf("malformed amt: %s", e.Err)
+}
+
+func (e *MalformedError) Unwrap() error {
+	return e.Err
+}
+
+func (e *MalformedError) Is(target error) bool {
+	return target == ErrMalformed
+}
+
+// malformedf returns a *MalformedError with the given description, for which
+// the block and height aren't yet known. See withBlock.
+func malformedf(format string, args ...interface{}) error {
+	return &MalformedError{Height: -1, Err: fmt.Errorf(format, args...)}
+}
+
+// decodeError reports err, returned by a store that couldn't decode a block
+// into what, as malformed. Other errors are returned as-is, as are those of an
+// amtStore, which reports the blocks it can't decode itself.
+func decodeError(err error, what string) error {
+	var se cbor.SerializationError
+	if errors.As(err, &se) {
+		return malformedf("decoding %s: %w", what, err)
+	}
+	return err
+}
+
+// withBlock fills in the CID and height of the block at fault where err is a
+// *MalformedError that doesn't yet have them, returning err.
+func withBlock(err error, c cid.Cid, height int) error {
+	var me *MalformedError
+	if errors.As(err, &me) {
+		if !me.Cid.Defined() {
+			me.Cid = c
+		}
+		if me.Height < 0 {
+			me.Height = height
+		}
+	}
+	return err
+}
+
+// blockError attributes err, found while checking the block c of a node at
+// the given height, to the block. height is -1 where it isn't known.
+func blockError(err error, c cid.Cid, height int) error {
+	if errors.Is(err, ErrMalformed) {
+		return withBlock(err, c, height)
+	}
+	return xerrors.Errorf("block %s: %w", c, err)
+}
+
+// indexOutOfRange returns the error for an index greater than MaxIndex.
+func indexOutOfRange(i uint64) error {
+	return fmt.Errorf("%w: %d", ErrIndexOutOfRange, i)
+}
@@ -0,0 +1,146 @@
+package amt
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/stretchr/testify/require"
+	cbg "github.com/whyrusleeping/cbor-gen"
+
+	"github.com/filecoin-project/go-amt-ipld/v4/internal"
+)
+
+func requireMalformed(t *testing.T, err error, c cid.Cid, height int) {
+	t.Helper()
+	require.ErrorIs(t, err, ErrMalformed)
+	var me *MalformedError
+	require.True(t, errors.As(err, &me))
+	require.Equal(t, c, me.Cid)
+	require.Equal(t, height, me.Height)
+	require.ErrorContains(t, err, c.String())
+}
+
+func TestCallerErrors(t *testing.T) {
+	ctx := context.Background()
+	bs := cbor.NewCborStore(newMockBlocks())
+
+	a, err := NewAMT(bs)
+	require.NoError(t, err)
+	_, err = a.FirstSetIndex(ctx)
+	require.ErrorIs(t, err, ErrNoValues)
+
+	require.ErrorIs(t, a.Set(ctx, MaxIndex+1, cborstr("foo")), ErrIndexOutOfRange)
+	_, err = a.Get(ctx, MaxIndex+1, nil)
+	require.ErrorIs(t, err, ErrIndexOutOfRange)
+	_, err = a.Delete(ctx, MaxIndex+1)
+	require.ErrorIs(t, err, ErrIndexOutOfRange)
+	_, err = a.Prove(ctx, MaxIndex+1)
+	require.ErrorIs(t, err, ErrIndexOutOfRange)
+
+	assertSet(t, a, 0, "foo")
+	_, err = a.BatchDelete(ctx, []uint64{0, 1}, true)
+	require.ErrorIs(t, err, ErrNotFound)
+	_, err = a.Prove(ctx, 1)
+	require.ErrorIs(t, err, ErrNotFound)
+
+	c, err := a.Flush(ctx)
+	require.NoError(t, err)
+	_, err = LoadAMT(ctx, bs, c, UseTreeBitWidth(4))
+	require.ErrorIs(t, err, ErrBitWidthMismatch)
+	require.NotErrorIs(t, err, ErrMalformed)
+	_, err = Diff(ctx, bs, bs, c, c, UseTreeBitWidth(4))
+	require.ErrorIs(t, err, ErrBitWidthMismatch)
+}
+
+func TestMalformedErrors(t *testing.T) {
+	ctx := context.Background()
+	bs := cbor.NewCborStore(newMockBlocks())
+	opts := []Option{UseTreeBitWidth(1)}
+	value := &cbg.Deferred{Raw: []byte{0x61, 0x61}}
+
+	good := putEncoded(ctx, t, bs, &internal.Node{Bmap: []byte{0x01}, Values: []*cbg.Deferred{value}})
+	bad := putEncoded(ctx, t, bs, &internal.Node{Bmap: []byte{0x01}, Links: []cid.Cid{good}, Values: []*cbg.Deferred{value}})
+
+	// a root too short for its count
+	short := putEncoded(ctx, t, bs, &internal.Root{
+		BitWidth: 1,
+		Count:    3,
+		Node:     internal.Node{Bmap: []byte{0x01}, Values: []*cbg.Deferred{value}},
+	})
+	_, err := LoadAMT(ctx, bs, short, opts...)
+	requireMalformed(t, err, short, 0)
+
+	// a root linking to a node with both links and values
+	root := putEncoded(ctx, t, bs, &internal.Root{
+		BitWidth: 1,
+		Height:   1,
+		Count:    2,
+		Node:     internal.Node{Bmap: []byte{0x03}, Links: []cid.Cid{good, bad}},
+	})
+	a, err := LoadAMT(ctx, bs, root, opts...)
+	require.NoError(t, err)
+	found, err := a.Get(ctx, 0, nil)
+	require.NoError(t, err)
+	require.True(t, found)
+	_, err = a.Get(ctx, 2, nil)
+	requireMalformed(t, err, bad, 0)
+	require.ErrorContains(t, err, "both links and values")
+
+	other := putEncoded(ctx, t, bs, &internal.Root{
+		BitWidth: 1,
+		Height:   1,
+		Count:    2,
+		Node:     internal.Node{Bmap: []byte{0x03}, Links: []cid.Cid{good, good}},
+	})
+	_, err = Diff(ctx, bs, bs, other, root, opts...)
+	requireMalformed(t, err, bad, 0)
+	err = WalkNodes(ctx, bs, root, func(NodeInfo) error { return nil }, opts...)
+	requireMalformed(t, err, bad, 0)
+	_, err = Copy(ctx, bs, cbor.NewCborStore(newMockBlocks()), root, opts...)
+	requireMalformed(t, err, bad, 0)
+
+	// a leaf holding links
+	links := putEncoded(ctx, t, bs, &internal.Node{Bmap: []byte{0x01}, Links: []cid.Cid{good}})
+	tall := putEncoded(ctx, t, bs, &internal.Root{
+		BitWidth: 1,
+		Height:   1,
+		Count:    2,
+		Node:     internal.Node{Bmap: []byte{0x03}, Links: []cid.Cid{good, links}},
+	})
+	a, err = LoadAMT(ctx, bs, tall, opts...)
+	require.NoError(t, err)
+	_, err = a.Get(ctx, 2, nil)
+	requireMalformed(t, err, links, 0)
+	require.ErrorContains(t, err, "at height 0: found links in a leaf")
+
+	// the same for non-canonical blocks
+	a, err = LoadAMT(ctx, bs, root, append(opts, StrictCanonical())...)
+	require.NoError(t, err)
+	_, err = a.Get(ctx, 2, nil)
+	requireMalformed(t, err, bad, 0)
+
+	// blocks that don't decode, whether or not options wrap the store
+	garbage := putBytes(ctx, t, bs, []byte{0x83, 0x01, 0x02})
+	garbageNode := putBytes(ctx, t, bs, []byte{0x82, 0x01, 0x02})
+	withGarbage := putEncoded(ctx, t, bs, &internal.Root{
+		BitWidth: 1,
+		Height:   1,
+		Count:    2,
+		Node:     internal.Node{Bmap: []byte{0x03}, Links: []cid.Cid{good, garbageNode}},
+	})
+	for _, extra := range [][]Option{nil, {MaxHeight(64)}} {
+		loadOpts := append(append([]Option(nil), opts...), extra...)
+		_, err = LoadAMT(ctx, bs, garbage, loadOpts...)
+		requireMalformed(t, err, garbage, -1)
+
+		a, err = LoadAMT(ctx, bs, withGarbage, loadOpts...)
+		require.NoError(t, err)
+		_, err = a.Get(ctx, 2, nil)
+		requireMalformed(t, err, garbageNode, 0)
+		_, err = a.Stats(ctx)
+		requireMalformed(t, err, garbageNode, 0)
+	}
+}
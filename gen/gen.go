@@ -7,7 +7,7 @@ import (
 )
 
 func main() {
-	if err := cbg.WriteTupleEncodersToFile("internal/cbor_gen.go", "internal", internal.Root{}, internal.Node{}); err != nil {
+	if err := cbg.WriteTupleEncodersToFile("internal/cbor_gen.go", "internal", internal.Root{}, internal.Node{}, internal.ChangeSetHeader{}, internal.Change{}, internal.Proof{}); err != nil {
 		panic(err)
 	}
 }
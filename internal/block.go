@@ -0,0 +1,20 @@
+package internal
+
+import (
+	"fmt"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+// CheckBlock checks that data hashes to the CID c, for blocks read from
+// sources that don't verify them, such as CARs and proofs.
+func CheckBlock(c cid.Cid, data []byte) error {
+	actual, err := c.Prefix().Sum(data)
+	if err != nil {
+		return fmt.Errorf("hashing block %s: %w", c, err)
+	}
+	if !actual.Equals(c) {
+		return fmt.Errorf("block %s doesn't match its CID", c)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	cid "github.com/ipfs/go-cid"
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+// MaxCARSectionSize limits the size of a single block read from a CAR.
+const MaxCARSectionSize = 32 << 20
+
+// WriteCARHeader writes a CARv1 header, the DAG-CBOR map
+// {"roots": roots, "version": 1}, prefixed with its length.
+func WriteCARHeader(w io.Writer, roots []cid.Cid) error {
+	var buf bytes.Buffer
+	cw := cbg.NewCborWriter(&buf)
+	if err := cw.WriteMajorTypeHeader(cbg.MajMap, 2); err != nil {
+		return err
+	}
+	if err := writeCBORString(cw, "roots"); err != nil {
+		return err
+	}
+	if err := cw.WriteMajorTypeHeader(cbg.MajArray, uint64(len(roots))); err != nil {
+		return err
+	}
+	for _, root := range roots {
+		if err := cbg.WriteCid(cw, root); err != nil {
+			return err
+		}
+	}
+	if err := writeCBORString(cw, "version"); err != nil {
+		return err
+	}
+	if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, 1); err != nil {
+		return err
+	}
+	return writeCARFrame(w, buf.Bytes())
+}
+
+func writeCBORString(cw *cbg.CborWriter, s string) error {
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len(s))); err != nil {
+		return err
+	}
+	_, err := io.WriteString(cw, s)
+	return err
+}
+
+// ReadCARHeader reads a CARv1 header and returns its roots.
+func ReadCARHeader(br *bufio.Reader) ([]cid.Cid, error) {
+	data, err := readCARFrame(br)
+	if err == io.EOF {
+		return nil, fmt.Errorf("reading CAR header: %w", io.ErrUnexpectedEOF)
+	} else if err != nil {
+		return nil, fmt.Errorf("reading CAR header: %w", err)
+	}
+
+	cr := cbg.NewCborReader(bytes.NewReader(data))
+	maj, extra, err := cr.ReadHeader()
+	if err != nil {
+		return nil, fmt.Errorf("reading CAR header: %w", err)
+	}
+	if maj != cbg.MajMap {
+		return nil, fmt.Errorf("CAR header should be a map")
+	}
+
+	var roots []cid.Cid
+	version := uint64(0)
+	for i := uint64(0); i < extra; i++ {
+		key, err := cbg.ReadStringWithMax(cr, 16)
+		if err != nil {
+			return nil, fmt.Errorf("reading CAR header: %w", err)
+		}
+		switch key {
+		case "roots":
+			maj, n, err := cr.ReadHeader()
+			if err != nil {
+				return nil, fmt.Errorf("reading CAR header: %w", err)
+			}
+			if maj != cbg.MajArray || n > cbg.MaxLength {
+				return nil, fmt.Errorf("CAR header roots should be an array")
+			}
+			for j := uint64(0); j < n; j++ {
+				c, err := cbg.ReadCid(cr)
+				if err != nil {
+					return nil, fmt.Errorf("reading CAR header: %w", err)
+				}
+				roots = append(roots, c)
+			}
+		case "version":
+			maj, v, err := cr.ReadHeader()
+			if err != nil {
+				return nil, fmt.Errorf("reading CAR header: %w", err)
+			}
+			if maj != cbg.MajUnsignedInt {
+				return nil, fmt.Errorf("CAR header version should be an integer")
+			}
+			version = v
+		default:
+			return nil, fmt.Errorf("unexpected CAR header field %q", key)
+		}
+	}
+	if version != 1 {
+		return nil, fmt.Errorf("unsupported CAR version %d", version)
+	}
+	return roots, nil
+}
+
+// WriteCARBlock writes a block as a CAR section: its CID followed by its data,
+// prefixed with their combined length.
+func WriteCARBlock(w io.Writer, c cid.Cid, data []byte) error {
+	return writeCARFrame(w, c.Bytes(), data)
+}
+
+// ReadCARBlock reads a single block from a CAR, returning io.EOF where the
+// stream ends cleanly between blocks. The block's data isn't checked against
+// its CID.
+func ReadCARBlock(br *bufio.Reader) (cid.Cid, []byte, error) {
+	data, err := readCARFrame(br)
+	if err != nil {
+		return cid.Undef, nil, err
+	}
+	n, c, err := cid.CidFromBytes(data)
+	if err != nil {
+		return cid.Undef, nil, fmt.Errorf("reading CAR section: %w", err)
+	}
+	return c, data[n:], nil
+}
+
+func writeCARFrame(w io.Writer, parts ...[]byte) error {
+	size := 0
+	for _, p := range parts {
+		size += len(p)
+	}
+	var prefix [binary.MaxVarintLen64]byte
+	if _, err := w.Write(prefix[:binary.PutUvarint(prefix[:], uint64(size))]); err != nil {
+		return err
+	}
+	for _, p := range parts {
+		if _, err := w.Write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readCARFrame(br *bufio.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(br)
+	if err != nil {
+		// io.EOF is only returned if nothing was read
+		return nil, err
+	}
+	if size == 0 || size > MaxCARSectionSize {
+		return nil, fmt.Errorf("invalid CAR section size %d", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(br, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return data, nil
+}
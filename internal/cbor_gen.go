@@ -321,3 +321,344 @@ func (t *Node) UnmarshalCBOR(r io.Reader) (err error) {
 	}
 	return nil
 }
+
+var lengthBufChangeSetHeader = []byte{130}
+
+func (t *ChangeSetHeader) MarshalCBOR(w io.Writer) error {
+	if t == nil {
+		_, err := w.Write(cbg.CborNull)
+		return err
+	}
+
+	cw := cbg.NewCborWriter(w)
+
+	if _, err := cw.Write(lengthBufChangeSetHeader); err != nil {
+		return err
+	}
+
+	// t.Prev (cid.Cid) (struct)
+
+	if err := cbg.WriteCid(cw, t.Prev); err != nil {
+		return xerrors.Errorf("failed to write cid field t.Prev: %w", err)
+	}
+
+	// t.Cur (cid.Cid) (struct)
+
+	if err := cbg.WriteCid(cw, t.Cur); err != nil {
+		return xerrors.Errorf("failed to write cid field t.Cur: %w", err)
+	}
+
+	return nil
+}
+
+func (t *ChangeSetHeader) UnmarshalCBOR(r io.Reader) (err error) {
+	*t = ChangeSetHeader{}
+
+	cr := cbg.NewCborReader(r)
+
+	maj, extra, err := cr.ReadHeader()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}()
+
+	if maj != cbg.MajArray {
+		return fmt.Errorf("cbor input should be of type array")
+	}
+
+	if extra != 2 {
+		return fmt.Errorf("cbor input had wrong number of fields")
+	}
+
+	// t.Prev (cid.Cid) (struct)
+
+	{
+
+		c, err := cbg.ReadCid(cr)
+		if err != nil {
+			return xerrors.Errorf("failed to read cid field t.Prev: %w", err)
+		}
+
+		t.Prev = c
+
+	}
+	// t.Cur (cid.Cid) (struct)
+
+	{
+
+		c, err := cbg.ReadCid(cr)
+		if err != nil {
+			return xerrors.Errorf("failed to read cid field t.Cur: %w", err)
+		}
+
+		t.Cur = c
+
+	}
+	return nil
+}
+
+var lengthBufChange = []byte{132}
+
+func (t *Change) MarshalCBOR(w io.Writer) error {
+	if t == nil {
+		_, err := w.Write(cbg.CborNull)
+		return err
+	}
+
+	cw := cbg.NewCborWriter(w)
+
+	if _, err := cw.Write(lengthBufChange); err != nil {
+		return err
+	}
+
+	// t.Type (uint64) (uint64)
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(t.Type)); err != nil {
+		return err
+	}
+
+	// t.Key (uint64) (uint64)
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(t.Key)); err != nil {
+		return err
+	}
+
+	// t.Before (typegen.Deferred) (struct)
+	if err := t.Before.MarshalCBOR(cw); err != nil {
+		return err
+	}
+
+	// t.After (typegen.Deferred) (struct)
+	if err := t.After.MarshalCBOR(cw); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (t *Change) UnmarshalCBOR(r io.Reader) (err error) {
+	*t = Change{}
+
+	cr := cbg.NewCborReader(r)
+
+	maj, extra, err := cr.ReadHeader()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}()
+
+	if maj != cbg.MajArray {
+		return fmt.Errorf("cbor input should be of type array")
+	}
+
+	if extra != 4 {
+		return fmt.Errorf("cbor input had wrong number of fields")
+	}
+
+	// t.Type (uint64) (uint64)
+
+	{
+
+		maj, extra, err = cr.ReadHeader()
+		if err != nil {
+			return err
+		}
+		if maj != cbg.MajUnsignedInt {
+			return fmt.Errorf("wrong type for uint64 field")
+		}
+		t.Type = uint64(extra)
+
+	}
+	// t.Key (uint64) (uint64)
+
+	{
+
+		maj, extra, err = cr.ReadHeader()
+		if err != nil {
+			return err
+		}
+		if maj != cbg.MajUnsignedInt {
+			return fmt.Errorf("wrong type for uint64 field")
+		}
+		t.Key = uint64(extra)
+
+	}
+	// t.Before (typegen.Deferred) (struct)
+
+	{
+
+		t.Before = new(cbg.Deferred)
+
+		if err := t.Before.UnmarshalCBOR(cr); err != nil {
+			return xerrors.Errorf("failed to read deferred field: %w", err)
+		}
+	}
+	// t.After (typegen.Deferred) (struct)
+
+	{
+
+		t.After = new(cbg.Deferred)
+
+		if err := t.After.UnmarshalCBOR(cr); err != nil {
+			return xerrors.Errorf("failed to read deferred field: %w", err)
+		}
+	}
+	return nil
+}
+
+var lengthBufProof = []byte{130}
+
+func (t *Proof) MarshalCBOR(w io.Writer) error {
+	if t == nil {
+		_, err := w.Write(cbg.CborNull)
+		return err
+	}
+
+	cw := cbg.NewCborWriter(w)
+
+	if _, err := cw.Write(lengthBufProof); err != nil {
+		return err
+	}
+
+	// t.Root ([]uint8) (slice)
+	if len(t.Root) > 2097152 {
+		return xerrors.Errorf("Byte array in field t.Root was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajByteString, uint64(len(t.Root))); err != nil {
+		return err
+	}
+
+	if _, err := cw.Write(t.Root); err != nil {
+		return err
+	}
+
+	// t.Nodes ([][]uint8) (slice)
+	if len(t.Nodes) > 1048576 {
+		return xerrors.Errorf("Slice value in field t.Nodes was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajArray, uint64(len(t.Nodes))); err != nil {
+		return err
+	}
+	for _, v := range t.Nodes {
+		if len(v) > 2097152 {
+			return xerrors.Errorf("Byte array in field v was too long")
+		}
+
+		if err := cw.WriteMajorTypeHeader(cbg.MajByteString, uint64(len(v))); err != nil {
+			return err
+		}
+
+		if _, err := cw.Write(v); err != nil {
+			return err
+		}
+
+	}
+	return nil
+}
+
+func (t *Proof) UnmarshalCBOR(r io.Reader) (err error) {
+	*t = Proof{}
+
+	cr := cbg.NewCborReader(r)
+
+	maj, extra, err := cr.ReadHeader()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}()
+
+	if maj != cbg.MajArray {
+		return fmt.Errorf("cbor input should be of type array")
+	}
+
+	if extra != 2 {
+		return fmt.Errorf("cbor input had wrong number of fields")
+	}
+
+	// t.Root ([]uint8) (slice)
+
+	maj, extra, err = cr.ReadHeader()
+	if err != nil {
+		return err
+	}
+
+	if extra > 2097152 {
+		return fmt.Errorf("t.Root: byte array too large (%d)", extra)
+	}
+	if maj != cbg.MajByteString {
+		return fmt.Errorf("expected byte array")
+	}
+
+	if extra > 0 {
+		t.Root = make([]uint8, extra)
+	}
+
+	if _, err := io.ReadFull(cr, t.Root); err != nil {
+		return err
+	}
+
+	// t.Nodes ([][]uint8) (slice)
+
+	maj, extra, err = cr.ReadHeader()
+	if err != nil {
+		return err
+	}
+
+	if extra > 1048576 {
+		return fmt.Errorf("t.Nodes: array too large (%d)", extra)
+	}
+
+	if maj != cbg.MajArray {
+		return fmt.Errorf("expected cbor array")
+	}
+
+	if extra > 0 {
+		t.Nodes = make([][]uint8, extra)
+	}
+
+	for i := 0; i < int(extra); i++ {
+		{
+			var maj byte
+			var extra uint64
+			var err error
+			_ = maj
+			_ = extra
+			_ = err
+
+			maj, extra, err = cr.ReadHeader()
+			if err != nil {
+				return err
+			}
+
+			if extra > 2097152 {
+				return fmt.Errorf("t.Nodes[i]: byte array too large (%d)", extra)
+			}
+			if maj != cbg.MajByteString {
+				return fmt.Errorf("expected byte array")
+			}
+
+			if extra > 0 {
+				t.Nodes[i] = make([]uint8, extra)
+			}
+
+			if _, err := io.ReadFull(cr, t.Nodes[i]); err != nil {
+				return err
+			}
+
+		}
+	}
+	return nil
+}
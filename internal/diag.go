@@ -0,0 +1,220 @@
+package internal
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+// maxDiagnosticDepth limits the nesting of CBOR items Diagnostic will follow.
+const maxDiagnosticDepth = 64
+
+// Diagnostic renders a single encoded CBOR item in the diagnostic notation of
+// RFC 8949, section 8. Links (tag 42) are rendered as 42(h'…') followed by a
+// comment holding the CID. Indefinite-length items, which DAG-CBOR doesn't
+// allow, are rejected, as is any trailing data.
+func Diagnostic(data []byte) (string, error) {
+	d := diagnostic{data: data}
+	if err := d.item(0); err != nil {
+		return "", err
+	}
+	if d.pos != len(d.data) {
+		return "", fmt.Errorf("%d bytes of trailing data after cbor item", len(d.data)-d.pos)
+	}
+	return d.out.String(), nil
+}
+
+type diagnostic struct {
+	data []byte
+	pos  int
+	out  strings.Builder
+}
+
+func (d *diagnostic) next(n uint64) ([]byte, error) {
+	if n > uint64(len(d.data)-d.pos) {
+		return nil, fmt.Errorf("cbor item truncated at offset %d", d.pos)
+	}
+	b := d.data[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return b, nil
+}
+
+// header reads the major type and argument of the next item, along with its
+// additional information, which distinguishes the widths of floats.
+func (d *diagnostic) header() (byte, byte, uint64, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	maj, info := b[0]>>5, b[0]&0x1f
+	switch {
+	case info < 24:
+		return maj, info, uint64(info), nil
+	case info <= 27:
+		arg, err := d.next(1 << (info - 24))
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		var v uint64
+		for _, c := range arg {
+			v = v<<8 | uint64(c)
+		}
+		return maj, info, v, nil
+	default:
+		return 0, 0, 0, fmt.Errorf("unsupported cbor additional information %d at offset %d", info, d.pos-1)
+	}
+}
+
+func (d *diagnostic) item(depth int) error {
+	if depth > maxDiagnosticDepth {
+		return fmt.Errorf("cbor items nested deeper than %d", maxDiagnosticDepth)
+	}
+	maj, info, arg, err := d.header()
+	if err != nil {
+		return err
+	}
+	switch maj {
+	case 0:
+		d.out.WriteString(strconv.FormatUint(arg, 10))
+	case 1:
+		if arg == math.MaxUint64 {
+			d.out.WriteString("-18446744073709551616")
+		} else {
+			d.out.WriteString("-" + strconv.FormatUint(arg+1, 10))
+		}
+	case 2:
+		b, err := d.next(arg)
+		if err != nil {
+			return err
+		}
+		d.out.WriteString("h'" + hex.EncodeToString(b) + "'")
+	case 3:
+		b, err := d.next(arg)
+		if err != nil {
+			return err
+		}
+		d.out.WriteString(strconv.Quote(string(b)))
+	case 4:
+		d.out.WriteString("[")
+		for i := uint64(0); i < arg; i++ {
+			if i > 0 {
+				d.out.WriteString(", ")
+			}
+			if err := d.item(depth + 1); err != nil {
+				return err
+			}
+		}
+		d.out.WriteString("]")
+	case 5:
+		d.out.WriteString("{")
+		for i := uint64(0); i < arg; i++ {
+			if i > 0 {
+				d.out.WriteString(", ")
+			}
+			if err := d.item(depth + 1); err != nil {
+				return err
+			}
+			d.out.WriteString(": ")
+			if err := d.item(depth + 1); err != nil {
+				return err
+			}
+		}
+		d.out.WriteString("}")
+	case 6:
+		d.out.WriteString(strconv.FormatUint(arg, 10) + "(")
+		start := d.pos
+		if err := d.item(depth + 1); err != nil {
+			return err
+		}
+		d.out.WriteString(")")
+		if arg == 42 {
+			d.link(d.data[start:d.pos])
+		}
+	case 7:
+		return d.simple(info, arg)
+	}
+	return nil
+}
+
+// link appends a comment with the CID held by a tag 42 item, if it is valid.
+func (d *diagnostic) link(item []byte) {
+	// a byte string header, then the multibase identity prefix
+	if len(item) < 2 || item[0]>>5 != 2 {
+		return
+	}
+	raw := item[1:]
+	switch item[0] & 0x1f {
+	case 24:
+		raw = item[2:]
+	case 25:
+		raw = item[3:]
+	}
+	if len(raw) == 0 || raw[0] != 0 {
+		return
+	}
+	if c, err := cid.Cast(raw[1:]); err == nil {
+		d.out.WriteString(" /" + c.String() + "/")
+	}
+}
+
+func (d *diagnostic) simple(info byte, arg uint64) error {
+	switch info {
+	case 20:
+		d.out.WriteString("false")
+	case 21:
+		d.out.WriteString("true")
+	case 22:
+		d.out.WriteString("null")
+	case 23:
+		d.out.WriteString("undefined")
+	case 25:
+		d.float(float64(float16(uint16(arg))))
+	case 26:
+		d.float(float64(math.Float32frombits(uint32(arg))))
+	case 27:
+		d.float(math.Float64frombits(arg))
+	default:
+		d.out.WriteString("simple(" + strconv.FormatUint(arg, 10) + ")")
+	}
+	return nil
+}
+
+func (d *diagnostic) float(f float64) {
+	switch {
+	case math.IsNaN(f):
+		d.out.WriteString("NaN")
+	case math.IsInf(f, 1):
+		d.out.WriteString("Infinity")
+	case math.IsInf(f, -1):
+		d.out.WriteString("-Infinity")
+	default:
+		s := strconv.FormatFloat(f, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".eE") {
+			s += ".0"
+		}
+		d.out.WriteString(s)
+	}
+}
+
+// float16 decodes an IEEE 754 half-precision float.
+func float16(h uint16) float32 {
+	sign := uint32(h>>15) << 31
+	exp := uint32(h>>10) & 0x1f
+	frac := uint32(h) & 0x3ff
+	switch exp {
+	case 0:
+		f := float32(frac) / (1 << 24)
+		if sign != 0 {
+			return -f
+		}
+		return f
+	case 0x1f:
+		return math.Float32frombits(sign | 0xff<<23 | frac<<13)
+	default:
+		return math.Float32frombits(sign | (exp+112)<<23 | frac<<13)
+	}
+}
@@ -76,3 +76,54 @@ type Root struct {
 	Count    uint64
 	Node     Node
 }
+
+// ChangeSetHeader is the first element of a serialized change set, identifying
+// the two AMT roots that were compared. It is followed by zero or more Change
+// elements, forming a CBOR sequence.
+//
+// The header is serialized in the following form, described as an IPLD Schema:
+//
+//	type ChangeSetHeader struct {
+//		prev &Root
+//		cur &Root
+//	} representation tuple
+type ChangeSetHeader struct {
+	Prev cid.Cid
+	Cur  cid.Cid
+}
+
+// Change is the serialized form of a single change to an AMT. Type is 0 for
+// an addition, 1 for a removal and 2 for a modification. Before is null for an
+// addition and After is null for a removal.
+//
+// Each change is serialized in the following form, described as an IPLD
+// Schema:
+//
+//	type Change struct {
+//		type Int
+//		key Int
+//		before nullable Any
+//		after nullable Any
+//	} representation tuple
+type Change struct {
+	Type   uint64
+	Key    uint64
+	Before *cbg.Deferred
+	After  *cbg.Deferred
+}
+
+// Proof holds the blocks needed to verify the contents of an AMT at one or
+// more indexes without access to the rest of the AMT. Root is the serialized
+// Root block and Nodes are serialized Node blocks below it, in depth-first
+// order, following links in ascending position.
+//
+// The proof is serialized in the following form, described as an IPLD Schema:
+//
+//	type Proof struct {
+//		root Bytes
+//		nodes [Bytes]
+//	} representation tuple
+type Proof struct {
+	Root  []byte
+	Nodes [][]byte `cborgen:"maxlen=1048576"`
+}
@@ -0,0 +1,197 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+
+	cid "github.com/ipfs/go-cid"
+	cbg "github.com/whyrusleeping/cbor-gen"
+	xerrors "golang.org/x/xerrors"
+)
+
+// ShallowNode decodes the same serialized form as Node, but skips over the
+// contents of each value, only recording its encoded size. It is used where
+// the shape of a node (its bitmap and links) is needed without paying to copy
+// the values it holds.
+type ShallowNode struct {
+	Bmap       []byte
+	Links      []cid.Cid
+	ValueSizes []int
+}
+
+func (t *ShallowNode) UnmarshalCBOR(r io.Reader) (err error) {
+	*t = ShallowNode{}
+
+	cr := cbg.NewCborReader(r)
+
+	maj, extra, err := cr.ReadHeader()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}()
+
+	if maj != cbg.MajArray {
+		return fmt.Errorf("cbor input should be of type array")
+	}
+
+	if extra != 3 {
+		return fmt.Errorf("cbor input had wrong number of fields")
+	}
+
+	// t.Bmap ([]uint8) (slice)
+
+	maj, extra, err = cr.ReadHeader()
+	if err != nil {
+		return err
+	}
+
+	if extra > 2097152 {
+		return fmt.Errorf("t.Bmap: byte array too large (%d)", extra)
+	}
+	if maj != cbg.MajByteString {
+		return fmt.Errorf("expected byte array")
+	}
+
+	if extra > 0 {
+		t.Bmap = make([]uint8, extra)
+	}
+
+	if _, err := io.ReadFull(cr, t.Bmap); err != nil {
+		return err
+	}
+
+	// t.Links ([]cid.Cid) (slice)
+
+	maj, extra, err = cr.ReadHeader()
+	if err != nil {
+		return err
+	}
+
+	if extra > 8192 {
+		return fmt.Errorf("t.Links: array too large (%d)", extra)
+	}
+
+	if maj != cbg.MajArray {
+		return fmt.Errorf("expected cbor array")
+	}
+
+	if extra > 0 {
+		t.Links = make([]cid.Cid, extra)
+	}
+
+	for i := 0; i < int(extra); i++ {
+		c, err := cbg.ReadCid(cr)
+		if err != nil {
+			return xerrors.Errorf("failed to read cid field t.Links[i]: %w", err)
+		}
+		t.Links[i] = c
+	}
+
+	// t.Values (skipped, sizes only)
+
+	maj, extra, err = cr.ReadHeader()
+	if err != nil {
+		return err
+	}
+
+	if extra > 8192 {
+		return fmt.Errorf("t.Values: array too large (%d)", extra)
+	}
+
+	if maj != cbg.MajArray {
+		return fmt.Errorf("expected cbor array")
+	}
+
+	if extra > 0 {
+		t.ValueSizes = make([]int, extra)
+	}
+
+	for i := 0; i < int(extra); i++ {
+		n, err := skipItem(cr)
+		if err != nil {
+			return xerrors.Errorf("failed to skip value t.Values[i]: %w", err)
+		}
+		t.ValueSizes[i] = n
+	}
+	return nil
+}
+
+// countingReader counts the bytes consumed from a BytePeeker, taking unread
+// bytes into account.
+type countingReader struct {
+	r cbg.BytePeeker
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+func (c *countingReader) UnreadByte() error {
+	if err := c.r.UnreadByte(); err != nil {
+		return err
+	}
+	c.n--
+	return nil
+}
+
+// skipItem reads past a single CBOR data item, applying the same limits as
+// cbg.Deferred, and returns the number of bytes it occupied.
+func skipItem(r io.Reader) (int, error) {
+	cnt := &countingReader{r: cbg.GetPeeker(r)}
+	cr := cbg.NewCborReader(cnt)
+
+	for remaining := uint64(1); remaining > 0; remaining-- {
+		maj, extra, err := cr.ReadHeader()
+		if err != nil {
+			if err == io.EOF && cnt.n > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+
+		switch maj {
+		case cbg.MajUnsignedInt, cbg.MajNegativeInt, cbg.MajOther:
+			// nothing to skip past the header
+		case cbg.MajByteString, cbg.MajTextString:
+			if extra > cbg.ByteArrayMaxLen {
+				return 0, fmt.Errorf("string in value too large (%d)", extra)
+			}
+			if n, err := io.CopyN(io.Discard, cr, int64(extra)); err != nil {
+				if err == io.EOF && n < int64(extra) {
+					err = io.ErrUnexpectedEOF
+				}
+				return 0, err
+			}
+		case cbg.MajTag:
+			remaining++
+		case cbg.MajArray:
+			if extra > cbg.MaxLength {
+				return 0, fmt.Errorf("array in value too large (%d)", extra)
+			}
+			remaining += extra
+		case cbg.MajMap:
+			if extra > cbg.MaxLength {
+				return 0, fmt.Errorf("map in value too large (%d)", extra)
+			}
+			remaining += extra * 2
+		default:
+			return 0, fmt.Errorf("unhandled cbor type in value: %d", maj)
+		}
+	}
+	return cnt.n, nil
+}
@@ -0,0 +1,118 @@
+package amt
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/stretchr/testify/require"
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+func requireLimitError(t *testing.T, err error, limit string) {
+	t.Helper()
+	require.ErrorIs(t, err, ErrLimitExceeded)
+	var le *LimitError
+	require.True(t, errors.As(err, &le))
+	require.Equal(t, limit, le.Limit)
+	require.Greater(t, le.Actual, le.Max)
+}
+
+func TestLimits(t *testing.T) {
+	ctx := context.Background()
+	bs := cbor.NewCborStore(newMockBlocks())
+	opts := []Option{UseTreeBitWidth(3)}
+
+	// a small leaf root
+	small, err := NewAMT(bs, opts...)
+	require.NoError(t, err)
+	assertSet(t, small, 0, "foo")
+	smallCid, err := small.Flush(ctx)
+	require.NoError(t, err)
+
+	// a root of height 6 with a large value in a leaf
+	big := strings.Repeat("x", 100)
+	tall, err := NewAMT(bs, opts...)
+	require.NoError(t, err)
+	for i := uint64(0); i < 100; i++ {
+		assertSet(t, tall, i, "foo")
+	}
+	assertSet(t, tall, 1<<20, big)
+	tallCid, err := tall.Flush(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 6, tall.height)
+
+	load := func(root cid.Cid, limits ...Option) error {
+		a, err := LoadAMT(ctx, bs, root, append(limits, opts...)...)
+		if err != nil {
+			return err
+		}
+		return a.ForEach(ctx, func(uint64, *cbg.Deferred) error { return nil })
+	}
+
+	var nodes, maxBytes int
+	require.NoError(t, WalkNodes(ctx, bs, tallCid, func(info NodeInfo) error {
+		nodes++
+		if info.Size > maxBytes {
+			maxBytes = info.Size
+		}
+		return nil
+	}, opts...))
+
+	require.NoError(t, load(tallCid, MaxBitWidth(3), MaxHeight(6), MaxNodeBytes(maxBytes), MaxValueBytes(len(big)+2), MaxNodesLoaded(nodes)))
+
+	requireLimitError(t, load(smallCid, MaxBitWidth(2)), "MaxBitWidth")
+	requireLimitError(t, load(tallCid, MaxHeight(5)), "MaxHeight")
+	requireLimitError(t, load(smallCid, MaxNodeBytes(4)), "MaxNodeBytes")
+	requireLimitError(t, load(tallCid, MaxNodeBytes(maxBytes-1)), "MaxNodeBytes")
+	requireLimitError(t, load(smallCid, MaxValueBytes(2)), "MaxValueBytes")
+	requireLimitError(t, load(tallCid, MaxValueBytes(50)), "MaxValueBytes")
+	requireLimitError(t, load(tallCid, MaxNodesLoaded(nodes-1)), "MaxNodesLoaded")
+
+	// nodes are only counted when read from the store
+	a, err := LoadAMT(ctx, bs, tallCid, append(opts, MaxNodesLoaded(nodes))...)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, a.ForEach(ctx, func(uint64, *cbg.Deferred) error { return nil }))
+	}
+
+	// the raw block paths
+	requireLimitError(t, WalkNodes(ctx, bs, tallCid, func(NodeInfo) error { return nil }, append(opts, MaxNodesLoaded(10))...), "MaxNodesLoaded")
+	requireLimitError(t, ExportCAR(ctx, bs, tallCid, new(bytes.Buffer), append(opts, MaxValueBytes(50))...), "MaxValueBytes")
+	_, err = Copy(ctx, bs, cbor.NewCborStore(newMockBlocks()), tallCid, append(opts, MaxNodeBytes(maxBytes-1))...)
+	requireLimitError(t, err, "MaxNodeBytes")
+
+	// each side of a diff is limited
+	_, err = Diff(ctx, bs, bs, smallCid, tallCid, append(opts, MaxNodesLoaded(10))...)
+	requireLimitError(t, err, "MaxNodesLoaded")
+	_, err = ParallelDiff(ctx, bs, bs, tallCid, smallCid, 4, append(opts, MaxValueBytes(50))...)
+	requireLimitError(t, err, "MaxValueBytes")
+	_, err = Diff(ctx, bs, bs, smallCid, tallCid, append(opts, MaxNodesLoaded(nodes))...)
+	require.NoError(t, err)
+
+	// so is each side of a merge
+	assertSet(t, small, 200, "bar")
+	otherCid, err := small.Flush(ctx)
+	require.NoError(t, err)
+	resolve := func(uint64, *cbg.Deferred, *cbg.Deferred, *cbg.Deferred) (*cbg.Deferred, error) {
+		return nil, errors.New("unexpected conflict")
+	}
+	_, err = Merge(ctx, bs, smallCid, tallCid, otherCid, resolve, append(opts, MaxNodesLoaded(2))...)
+	requireLimitError(t, err, "MaxNodesLoaded")
+	_, err = Merge(ctx, bs, smallCid, tallCid, otherCid, resolve, append(opts, MaxNodesLoaded(nodes))...)
+	require.NoError(t, err)
+}
+
+func TestLimitOptions(t *testing.T) {
+	ctx := context.Background()
+	bs := cbor.NewCborStore(newMockBlocks())
+	for _, opt := range []Option{MaxHeight(-1), MaxNodeBytes(0), MaxValueBytes(0), MaxNodesLoaded(0)} {
+		_, err := LoadAMT(ctx, bs, cid.Undef, opt)
+		require.Error(t, err)
+		require.NotErrorIs(t, err, ErrLimitExceeded)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/filecoin-project/go-amt-ipld/v4/internal"
 	cid "github.com/ipfs/go-cid"
 	cbor "github.com/ipfs/go-ipld-cbor"
+	cbg "github.com/whyrusleeping/cbor-gen"
 )
 
 type link struct {
@@ -16,21 +17,73 @@ type link struct {
 }
 
 func (l *link) load(ctx context.Context, bs cbor.IpldStore, bitWidth uint, height int) (*node, error) {
+	traceNode(bs, height, l.cached != nil)
 	if l.cached == nil {
 		var nd internal.Node
 		if err := bs.Get(ctx, l.cid, &nd); err != nil {
-			return nil, err
+			return nil, withBlock(decodeError(err, "node"), l.cid, height)
 		}
 
 		n, err := newNode(nd, bitWidth, false, height == 0)
 		if err != nil {
-			return nil, err
+			return nil, withBlock(err, l.cid, height)
 		}
 		l.cached = n
 	}
 	return l.cached, nil
 }
 
+// peek returns the node behind this link like load, but where the node isn't
+// already cached, the result is not cached either.
+func (l *link) peek(ctx context.Context, bs cbor.IpldStore, bitWidth uint, height int) (*node, error) {
+	traceNode(bs, height, l.cached != nil)
+	if l.cached != nil {
+		return l.cached, nil
+	}
+
+	var nd internal.Node
+	if err := bs.Get(ctx, l.cid, &nd); err != nil {
+		return nil, withBlock(decodeError(err, "node"), l.cid, height)
+	}
+	n, err := newNode(nd, bitWidth, false, height == 0)
+	if err != nil {
+		return nil, withBlock(err, l.cid, height)
+	}
+	return n, nil
+}
+
+// placeholderValue stands in for the values of nodes loaded by loadShallow.
+var placeholderValue = &cbg.Deferred{Raw: cbg.CborNull}
+
+// loadShallow returns the node behind this link with the same validation as
+// load, but without decoding the values of a leaf node. Values are replaced
+// with placeholders, so only their positions are meaningful. Where the node
+// isn't already cached, the result is not cached either.
+func (l *link) loadShallow(ctx context.Context, bs cbor.IpldStore, bitWidth uint, height int) (*node, error) {
+	traceNode(bs, height, l.cached != nil)
+	if l.cached != nil {
+		return l.cached, nil
+	}
+
+	var sn internal.ShallowNode
+	if err := bs.Get(ctx, l.cid, &sn); err != nil {
+		return nil, withBlock(decodeError(err, "node"), l.cid, height)
+	}
+
+	nd := internal.Node{Bmap: sn.Bmap, Links: sn.Links}
+	if len(sn.ValueSizes) > 0 {
+		nd.Values = make([]*cbg.Deferred, len(sn.ValueSizes))
+		for i := range nd.Values {
+			nd.Values[i] = placeholderValue
+		}
+	}
+	n, err := newNode(nd, bitWidth, false, height == 0)
+	if err != nil {
+		return nil, withBlock(err, l.cid, height)
+	}
+	return n, nil
+}
+
 func (l *link) clone() *link {
 	if l == nil {
 		return nil
@@ -0,0 +1,268 @@
+package amt
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	cbg "github.com/whyrusleeping/cbor-gen"
+	"golang.org/x/xerrors"
+)
+
+// Merge performs a three-way merge of the AMTs at left and right, which were
+// both derived from the AMT at base, and returns the root CID of the result.
+// opts are applied to all three AMTs, which must share a bitWidth.
+//
+// An index changed on only one side takes the value from that side, and an
+// index changed identically on both sides takes that value. Like Diff, the
+// merge is structural: a subtree changed on only one side is taken by CID
+// without being walked. Where both sides changed an index differently, resolve
+// is called with the base, left and right values (nil where the index is not
+// set) and returns the value to keep, or nil to leave the index unset.
+func Merge(ctx context.Context, bs cbor.IpldStore, base, left, right cid.Cid,
+	resolve func(key uint64, base, l, r *cbg.Deferred) (*cbg.Deferred, error), opts ...Option) (cid.Cid, error) {
+	// fast paths where the result is one of the inputs
+	switch {
+	case left == right, right == base:
+		return left, nil
+	case left == base:
+		return right, nil
+	}
+
+	cfg := defaultConfig()
+	for _, opt := range opts {
+		if err := opt(cfg); err != nil {
+			return cid.Undef, err
+		}
+	}
+	if cfg.tracer != nil && cfg.traceCounter == nil {
+		cfg.traceCounter = newTraceCounter()
+	}
+
+	var roots [3]*Root
+	for i, c := range []cid.Cid{base, left, right} {
+		r, err := LoadAMT(ctx, bs, c, opts...)
+		if err != nil {
+			return cid.Undef, xerrors.Errorf("loading root %s: %w", c, err)
+		}
+		roots[i] = r
+	}
+
+	m := &merger{
+		bitWidth: roots[0].bitWidth,
+		resolve:  resolve,
+	}
+	var sides [3]side
+	height := 0
+	for i, r := range roots {
+		nc := &nodeContext{bs: r.store, bitWidth: r.bitWidth, height: r.height}
+		id := cid.Undef
+		if r.count != 0 {
+			var err error
+			if id, err = rootNodeCid(r, []cid.Cid{base, left, right}[i].Prefix()); err != nil {
+				return cid.Undef, err
+			}
+		}
+		sides[i] = rootSide(r, nc, id)
+		height = max(height, r.height)
+	}
+
+	ln, err := m.mergeAt(ctx, height, 0, sides[0], sides[1], sides[2])
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	// Every index in the result either came from the side that changed it, in
+	// which case it's accounted for by "left + right - base", or was changed by
+	// both sides, in which case m.correction accounts for the difference.
+	result := &Root{
+		bitWidth: m.bitWidth,
+		height:   height,
+		count:    roots[1].count + roots[2].count - roots[0].count + m.correction,
+		node:     new(node),
+		store:    cfg.wrapStore(bs, newLoadChecker(cfg)),
+		tracer:   cfg.tracer,
+		trace:    cfg.traceCounter,
+	}
+	if ln != nil {
+		if result.node, err = ln.load(ctx, result.store, m.bitWidth, height); err != nil {
+			return cid.Undef, err
+		}
+		// Reduce the height to the canonical form, see Delete.
+		if result.height, err = result.node.collapse(ctx, result.store, m.bitWidth, height); err != nil {
+			return cid.Undef, err
+		}
+	} else {
+		result.height = 0
+	}
+
+	return result.Flush(ctx)
+}
+
+// merger holds the state of a single Merge.
+type merger struct {
+	bitWidth uint
+	resolve  func(key uint64, base, l, r *cbg.Deferred) (*cbg.Deferred, error)
+
+	// correction is the difference between the number of set indexes in the
+	// parts of the result that were changed on both sides and the number
+	// assumed by "left + right - base". It's modulo 2^64, like the counts.
+	correction uint64
+}
+
+// rootNodeCid returns the CID the root node of r would have if it were stored
+// as a block with the given prefix, so that the root of a shorter AMT can be
+// compared with the links of taller ones.
+func rootNodeCid(r *Root, prefix cid.Prefix) (cid.Cid, error) {
+	nd, err := r.node.compact(r.bitWidth, r.height)
+	if err != nil {
+		return cid.Undef, err
+	}
+	data, err := cborToBytes(nd)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return prefix.Sum(data)
+}
+
+// adopt returns a link to this side's subtree, for use at height h of a merge
+// result.
+func (s side) adopt(bitWidth uint, h int) *link {
+	if s.ln == nil {
+		return nil
+	}
+	var ln *link
+	if s.ln.cid.Defined() && !s.ln.dirty {
+		ln = &link{cid: s.ln.cid}
+	} else {
+		ln = &link{cached: s.ln.cached, dirty: true}
+	}
+	// build the left-most spine this side would have at height h
+	for ht := s.nc.height; ht < h; ht++ {
+		nd := &node{links: make([]*link, 1<<bitWidth)}
+		nd.links[0] = ln
+		ln = &link{cached: nd, dirty: true}
+	}
+	return ln
+}
+
+// count returns the number of indexes set in this side's subtree.
+func (s side) count(ctx context.Context) (uint64, error) {
+	if s.ln == nil {
+		return 0, nil
+	}
+	var n uint64
+	err := forEachKey(ctx, s.nc, s.ln, 0, func(uint64) error {
+		n++
+		return nil
+	})
+	return n, err
+}
+
+// mergeAt merges the three subtrees at height h, where the left-most index is
+// offset, and returns a link to the result or nil if the result is empty.
+func (m *merger) mergeAt(ctx context.Context, h int, offset uint64, base, left, right side) (*link, error) {
+	switch {
+	case left.same(right):
+		if !left.same(base) {
+			// both sides made the same changes, so each index in this subtree
+			// was counted twice in "left + right - base"
+			b, err := base.count(ctx)
+			if err != nil {
+				return nil, err
+			}
+			l, err := left.count(ctx)
+			if err != nil {
+				return nil, err
+			}
+			m.correction += b - l
+		}
+		return left.adopt(m.bitWidth, h), nil
+	case left.same(base):
+		return right.adopt(m.bitWidth, h), nil
+	case right.same(base):
+		return left.adopt(m.bitWidth, h), nil
+	}
+
+	nd := new(node)
+	if h == 0 {
+		var leaves [3]*node
+		for i, s := range []side{base, left, right} {
+			if s.ln == nil {
+				leaves[i] = new(node)
+				continue
+			}
+			n, err := s.nc.load(ctx, s.ln, offset)
+			if err != nil {
+				return nil, err
+			}
+			leaves[i] = n
+		}
+		for i := uint64(0); i < 1<<m.bitWidth; i++ {
+			v, err := m.mergeValue(offset+i, leaves[0].getValue(i), leaves[1].getValue(i), leaves[2].getValue(i))
+			if err != nil {
+				return nil, err
+			}
+			nd.setValue(m.bitWidth, i, v)
+		}
+	} else {
+		var children [3][]side
+		for j, s := range []side{base, left, right} {
+			c, err := s.children(ctx, h, offset, m.bitWidth)
+			if err != nil {
+				return nil, err
+			}
+			children[j] = c
+		}
+		subCount := nodesForHeight(m.bitWidth, h)
+		for i := uint64(0); i < 1<<m.bitWidth; i++ {
+			ln, err := m.mergeAt(ctx, h-1, offset+(i*subCount), children[0][i], children[1][i], children[2][i])
+			if err != nil {
+				return nil, err
+			}
+			nd.setLink(m.bitWidth, i, ln)
+		}
+	}
+
+	if nd.empty() {
+		return nil, nil
+	}
+	return &link{cached: nd, dirty: true}, nil
+}
+
+// mergeValue merges the values of a single index, calling resolve where both
+// sides changed it differently.
+func (m *merger) mergeValue(key uint64, base, left, right *cbg.Deferred) (*cbg.Deferred, error) {
+	var v *cbg.Deferred
+	switch {
+	case sameValue(left, right), sameValue(right, base):
+		v = left
+	case sameValue(left, base):
+		v = right
+	default:
+		var err error
+		if v, err = m.resolve(key, base, left, right); err != nil {
+			return nil, xerrors.Errorf("resolving conflict at index %d: %w", key, err)
+		}
+		if v != nil && v.Raw == nil {
+			return nil, xerrors.Errorf("resolving conflict at index %d: resolved value has no data", key)
+		}
+	}
+
+	present := func(d *cbg.Deferred) uint64 {
+		if d == nil {
+			return 0
+		}
+		return 1
+	}
+	m.correction += present(v) + present(base) - present(left) - present(right)
+	return v, nil
+}
+
+func sameValue(a, b *cbg.Deferred) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return bytes.Equal(a.Raw, b.Raw)
+}
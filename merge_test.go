@@ -0,0 +1,227 @@
+package amt
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/stretchr/testify/require"
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+// buildAMT builds an AMT holding exactly the given values.
+func buildAMT(ctx context.Context, t *testing.T, bs cbor.IpldStore, vals map[uint64]string, opts ...Option) *Root {
+	a, err := NewAMT(bs, opts...)
+	require.NoError(t, err)
+	for i, v := range vals {
+		require.NoError(t, a.Set(ctx, i, cborstr(v)))
+	}
+	_, err = a.Flush(ctx)
+	require.NoError(t, err)
+	return a
+}
+
+func TestMerge(t *testing.T) {
+	runTestWithBitWidths(t, bitWidths2to3, func(t *testing.T, opts ...Option) {
+		ctx := context.Background()
+		bs := cbor.NewCborStore(newMockBlocks())
+		rnd := rand.New(rand.NewSource(1))
+
+		for round := 0; round < 20; round++ {
+			base := make(map[uint64]string)
+			for i := 0; i < 200; i++ {
+				base[uint64(rnd.Intn(2000))] = "base"
+			}
+			left := make(map[uint64]string)
+			right := make(map[uint64]string)
+			for k, v := range base {
+				left[k] = v
+				right[k] = v
+			}
+
+			// left edits the lower part of the range, right the upper part,
+			// and both edit the middle
+			edit := func(vals map[uint64]string, lo, hi int, name string) {
+				for i := 0; i < 50; i++ {
+					k := uint64(lo + rnd.Intn(hi-lo))
+					if rnd.Intn(3) == 0 {
+						delete(vals, k)
+					} else {
+						vals[k] = name
+					}
+				}
+			}
+			edit(left, 0, 1100, "left")
+			edit(right, 900, 2000, "right")
+			if round%2 == 0 {
+				// grow one side and shrink the other
+				left[1<<20] = "left"
+				for k := range right {
+					if k > 100 {
+						delete(right, k)
+					}
+				}
+			}
+
+			expected := make(map[uint64]string)
+			conflicts := make(map[uint64]bool)
+			keys := make(map[uint64]bool)
+			for _, m := range []map[uint64]string{base, left, right} {
+				for k := range m {
+					keys[k] = true
+				}
+			}
+			for k := range keys {
+				b, bok := base[k]
+				l, lok := left[k]
+				r, rok := right[k]
+				switch {
+				case lok == rok && l == r:
+					if lok {
+						expected[k] = l
+					}
+				case lok == bok && l == b:
+					if rok {
+						expected[k] = r
+					}
+				case rok == bok && r == b:
+					if lok {
+						expected[k] = l
+					}
+				default:
+					conflicts[k] = true
+					// keep the right side, unless it removed the index
+					if rok {
+						expected[k] = r
+					} else if lok {
+						expected[k] = l
+					}
+				}
+			}
+
+			baseCid, err := buildAMT(ctx, t, bs, base, opts...).Flush(ctx)
+			require.NoError(t, err)
+			leftCid, err := buildAMT(ctx, t, bs, left, opts...).Flush(ctx)
+			require.NoError(t, err)
+			rightCid, err := buildAMT(ctx, t, bs, right, opts...).Flush(ctx)
+			require.NoError(t, err)
+			expectedAMT := buildAMT(ctx, t, bs, expected, opts...)
+			expectedCid, err := expectedAMT.Flush(ctx)
+			require.NoError(t, err)
+
+			resolved := make(map[uint64]bool)
+			merged, err := Merge(ctx, bs, baseCid, leftCid, rightCid, func(key uint64, b, l, r *cbg.Deferred) (*cbg.Deferred, error) {
+				require.False(t, resolved[key])
+				resolved[key] = true
+				if r != nil {
+					return r, nil
+				}
+				return l, nil
+			}, opts...)
+			require.NoError(t, err)
+			require.Equal(t, expectedCid, merged)
+			require.Equal(t, conflicts, resolved)
+
+			result, err := LoadAMT(ctx, bs, merged, opts...)
+			require.NoError(t, err)
+			require.Equal(t, expectedAMT.Len(), result.Len())
+		}
+	})
+}
+
+func TestMergeTakesSubtreesByCID(t *testing.T) {
+	ctx := context.Background()
+	mock := newMockBlocks()
+	bs := cbor.NewCborStore(mock)
+
+	base := make(map[uint64]string)
+	for i := uint64(0); i < 1000; i++ {
+		base[i] = "base"
+	}
+	left := map[uint64]string{}
+	right := map[uint64]string{}
+	for k, v := range base {
+		left[k], right[k] = v, v
+	}
+	left[1] = "left"
+	right[998] = "right"
+
+	baseCid, err := buildAMT(ctx, t, bs, base).Flush(ctx)
+	require.NoError(t, err)
+	leftCid, err := buildAMT(ctx, t, bs, left).Flush(ctx)
+	require.NoError(t, err)
+	rightCid, err := buildAMT(ctx, t, bs, right).Flush(ctx)
+	require.NoError(t, err)
+
+	mock.getCount = 0
+	merged, err := Merge(ctx, bs, baseCid, leftCid, rightCid, func(uint64, *cbg.Deferred, *cbg.Deferred, *cbg.Deferred) (*cbg.Deferred, error) {
+		t.Fatal("unexpected conflict")
+		return nil, nil
+	})
+	require.NoError(t, err)
+	// the three roots plus the two changed paths below them, not the whole
+	// tree
+	require.Less(t, mock.getCount, 20)
+
+	result, err := LoadAMT(ctx, bs, merged)
+	require.NoError(t, err)
+	assertGet(ctx, t, result, 1, "left")
+	assertGet(ctx, t, result, 998, "right")
+	assertGet(ctx, t, result, 500, "base")
+	assertCount(t, result, 1000)
+}
+
+func TestMergeDifferentHeights(t *testing.T) {
+	ctx := context.Background()
+	mock := newMockBlocks()
+	bs := cbor.NewCborStore(mock)
+	opts := []Option{UseTreeBitWidth(2)}
+
+	base := make(map[uint64]string)
+	for i := uint64(0); i < 16; i++ {
+		base[i] = "base"
+	}
+	left := map[uint64]string{100: "left"}
+	right := map[uint64]string{5: "right"}
+	for k, v := range base {
+		left[k] = v
+		if _, ok := right[k]; !ok {
+			right[k] = v
+		}
+	}
+
+	baseAmt := buildAMT(ctx, t, bs, base, opts...)
+	baseCid, err := baseAmt.Flush(ctx)
+	require.NoError(t, err)
+	leftAmt := buildAMT(ctx, t, bs, left, opts...)
+	leftCid, err := leftAmt.Flush(ctx)
+	require.NoError(t, err)
+	rightCid, err := buildAMT(ctx, t, bs, right, opts...).Flush(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, baseAmt.height)
+	require.Equal(t, 3, leftAmt.height)
+
+	// The taller left AMT links to base's root node as a block of its own.
+	// Remove it, so that the merge fails if it's loaded rather than taken by
+	// CID.
+	shared, err := rootNodeCid(baseAmt, baseCid.Prefix())
+	require.NoError(t, err)
+	blk, ok := mock.data[shared]
+	require.True(t, ok)
+	delete(mock.data, shared)
+
+	merged, err := Merge(ctx, bs, baseCid, leftCid, rightCid, func(uint64, *cbg.Deferred, *cbg.Deferred, *cbg.Deferred) (*cbg.Deferred, error) {
+		t.Fatal("unexpected conflict")
+		return nil, nil
+	}, opts...)
+	require.NoError(t, err)
+	mock.data[shared] = blk
+
+	result, err := LoadAMT(ctx, bs, merged, opts...)
+	require.NoError(t, err)
+	assertGet(ctx, t, result, 0, "base")
+	assertGet(ctx, t, result, 5, "right")
+	assertGet(ctx, t, result, 100, "left")
+	assertCount(t, result, 17)
+}
@@ -0,0 +1,208 @@
+package amt
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/stretchr/testify/require"
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+var errBudget = errors.New("out of budget")
+
+// testMeter counts the calls made to it, failing once more than maxGets or
+// maxPuts blocks have been read or written, where they are non-zero.
+type testMeter struct {
+	lk                       sync.Mutex
+	gets, decodes, encodes   int
+	puts                     int
+	getBytes, putBytes       int
+	encodeBytes, decodeBytes int
+	maxGets, maxPuts         int
+}
+
+func (m *testMeter) OnGet(_ cid.Cid, size int) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.gets++
+	m.getBytes += size
+	if m.maxGets > 0 && m.gets > m.maxGets {
+		return errBudget
+	}
+	return nil
+}
+
+func (m *testMeter) OnDecode(_ cid.Cid, size int) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.decodes++
+	m.decodeBytes += size
+	return nil
+}
+
+func (m *testMeter) OnEncode(size int) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.encodes++
+	m.encodeBytes += size
+	return nil
+}
+
+func (m *testMeter) OnPut(_ cid.Cid, size int) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.puts++
+	m.putBytes += size
+	if m.maxPuts > 0 && m.puts > m.maxPuts {
+		return errBudget
+	}
+	return nil
+}
+
+func TestMeter(t *testing.T) {
+	runTestWithBitWidths(t, bitWidths2to18, func(t *testing.T, opts ...Option) {
+		ctx := context.Background()
+		mock := newMockBlocks()
+		bs := cbor.NewCborStore(mock)
+
+		var m testMeter
+		opts = append(opts, UseMeter(&m))
+		a, err := NewAMT(bs, opts...)
+		require.NoError(t, err)
+		for i := uint64(0); i < 100; i++ {
+			assertSet(t, a, i*3, "foo")
+		}
+		root, err := a.Flush(ctx)
+		require.NoError(t, err)
+
+		var stored int
+		require.NoError(t, WalkNodes(ctx, bs, root, func(info NodeInfo) error {
+			stored += info.Size
+			return nil
+		}, opts...))
+		require.Equal(t, mock.putCount, m.puts)
+		require.Equal(t, m.puts, m.encodes)
+		require.Equal(t, stored, m.putBytes)
+		require.Equal(t, stored, m.encodeBytes)
+
+		// WalkNodes reads every block but decodes none of them from the store
+		require.Equal(t, mock.getCount, m.gets)
+		require.Equal(t, stored, m.getBytes)
+		require.Zero(t, m.decodes)
+
+		m = testMeter{}
+		mock.getCount = 0
+		a, err = LoadAMT(ctx, bs, root, opts...)
+		require.NoError(t, err)
+		require.NoError(t, a.ForEach(ctx, func(uint64, *cbg.Deferred) error { return nil }))
+		require.Equal(t, mock.getCount, m.gets)
+		require.Equal(t, m.gets, m.decodes)
+		require.Equal(t, stored, m.getBytes)
+		require.Equal(t, stored, m.decodeBytes)
+
+		// each side of a diff is read
+		assertDelete(t, a, 0)
+		changed, err := a.Flush(ctx)
+		require.NoError(t, err)
+		for _, diff := range []func() error{
+			func() error {
+				_, err := Diff(ctx, bs, bs, root, changed, opts...)
+				return err
+			},
+			func() error {
+				_, err := ParallelDiff(ctx, bs, bs, root, changed, 4, opts...)
+				return err
+			},
+		} {
+			m = testMeter{}
+			mock.getCount = 0
+			require.NoError(t, diff())
+			require.Equal(t, mock.getCount, m.gets)
+			require.Equal(t, m.gets, m.decodes)
+			require.NotZero(t, m.gets)
+		}
+
+		// a merge reads each side and writes its result through the meter
+		assertSet(t, a, 1000, "bar")
+		changedAgain, err := a.Flush(ctx)
+		require.NoError(t, err)
+		a, err = LoadAMT(ctx, bs, root, opts...)
+		require.NoError(t, err)
+		assertSet(t, a, 1, "bar")
+		other, err := a.Flush(ctx)
+		require.NoError(t, err)
+		m = testMeter{}
+		mock.getCount, mock.putCount = 0, 0
+		_, err = Merge(ctx, bs, changed, changedAgain, other, func(uint64, *cbg.Deferred, *cbg.Deferred, *cbg.Deferred) (*cbg.Deferred, error) {
+			return nil, errors.New("unexpected conflict")
+		}, opts...)
+		require.NoError(t, err)
+		require.Equal(t, mock.getCount, m.gets)
+		require.Equal(t, mock.putCount, m.puts)
+		require.Equal(t, m.puts, m.encodes)
+		require.NotZero(t, m.puts)
+
+		// blocks sent by NewBlocks are read raw, so are metered but not decoded
+		m = testMeter{}
+		mock.getCount = 0
+		require.NoError(t, NewBlocks(ctx, bs, root, changed, func(cid.Cid, []byte) error { return nil }, opts...))
+		require.Equal(t, mock.getCount, m.gets)
+		require.Less(t, m.decodes, m.gets)
+
+		// copies are metered on both sides
+		m = testMeter{}
+		mock.getCount = 0
+		dstMock := newMockBlocks()
+		stats, err := Copy(ctx, bs, cbor.NewCborStore(dstMock), root, opts...)
+		require.NoError(t, err)
+		require.Equal(t, mock.getCount, m.gets)
+		require.Equal(t, dstMock.putCount, m.puts)
+		require.Equal(t, int(stats.Bytes), m.putBytes)
+		require.Zero(t, m.encodes)
+	})
+}
+
+func TestMeterBudget(t *testing.T) {
+	ctx := context.Background()
+	bs := cbor.NewCborStore(newMockBlocks())
+	opts := []Option{UseTreeBitWidth(2)}
+
+	a, err := NewAMT(bs, opts...)
+	require.NoError(t, err)
+	for i := uint64(0); i < 100; i++ {
+		assertSet(t, a, i, "foo")
+	}
+	root, err := a.Flush(ctx)
+	require.NoError(t, err)
+
+	m := &testMeter{maxGets: 5}
+	a, err = LoadAMT(ctx, bs, root, append(opts, UseMeter(m))...)
+	require.NoError(t, err)
+	err = a.ForEach(ctx, func(uint64, *cbg.Deferred) error { return nil })
+	require.ErrorIs(t, err, errBudget)
+	require.Equal(t, 6, m.gets)
+
+	empty, err := NewAMT(bs, opts...)
+	require.NoError(t, err)
+	emptyRoot, err := empty.Flush(ctx)
+	require.NoError(t, err)
+	_, err = Diff(ctx, bs, bs, emptyRoot, root, append(opts, UseMeter(&testMeter{maxGets: 5}))...)
+	require.ErrorIs(t, err, errBudget)
+	require.NoError(t, ExportCAR(ctx, bs, root, new(bytes.Buffer), opts...))
+	require.ErrorIs(t, ExportCAR(ctx, bs, root, new(bytes.Buffer), append(opts, UseMeter(&testMeter{maxGets: 5}))...), errBudget)
+
+	m = &testMeter{maxPuts: 3}
+	a, err = NewAMT(bs, append(opts, UseMeter(m))...)
+	require.NoError(t, err)
+	for i := uint64(0); i < 100; i++ {
+		assertSet(t, a, i, "bar")
+	}
+	_, err = a.Flush(ctx)
+	require.ErrorIs(t, err, errBudget)
+	require.Equal(t, 4, m.puts)
+}
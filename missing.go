@@ -0,0 +1,156 @@
+package amt
+
+import (
+	"context"
+	"math"
+
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// MissingNode describes a node of an AMT that isn't in the store, and so the
+// range of indexes whose values can't be known without it.
+type MissingNode struct {
+	// Cid is the CID of the missing node.
+	Cid cid.Cid
+	// Height is the height of the missing node, 0 for a leaf, or -1 where the
+	// missing block is the root, whose height isn't known until it is read.
+	Height int
+	// Start is the first index covered by the node and End the index after
+	// the last. End saturates at math.MaxUint64, which is one past MaxIndex.
+	Start, End uint64
+}
+
+// newMissingNode describes the missing node c at the given height, with its
+// left-most element at offset. span is the number of indexes the node covers.
+func newMissingNode(c cid.Cid, height int, offset, span uint64) MissingNode {
+	return MissingNode{
+		Cid:    c,
+		Height: height,
+		Start:  offset,
+		End:    spanEnd(offset, span),
+	}
+}
+
+// isNotFound reports whether err is the error of a store that doesn't hold
+// the block asked for, which by convention matches ipld.ErrNotFound.
+func isNotFound(err error) bool {
+	return err != nil && ipld.IsNotFound(err)
+}
+
+// MissingBlocks walks the AMT at root, reading the nodes that are in bs, and
+// returns the nodes that aren't, in index order. Nothing is known about the
+// nodes below those returned, so once they are fetched, MissingBlocks must be
+// called again to find any still missing; see MissingFrontier to avoid
+// reading the same nodes again each time.
+func MissingBlocks(ctx context.Context, bs cbor.IpldStore, root cid.Cid, opts ...Option) ([]MissingNode, error) {
+	f, err := NewMissingFrontier(bs, root, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return f.Next(ctx)
+}
+
+// MissingFrontier finds the blocks of an AMT missing from a store round by
+// round, so that a fetcher can request each round in parallel. Every call to
+// Next returns the missing nodes whose parents are now in the store, reading
+// only the nodes fetched since the last call.
+type MissingFrontier struct {
+	bs   cbor.IpldStore
+	lc   *loadChecker
+	root cid.Cid
+	// rootRead is set once the root has been read, after which next holds
+	// the nodes returned by the last call to Next.
+	rootRead bool
+	next     []MissingNode
+}
+
+// NewMissingFrontier returns a MissingFrontier for the AMT at root, held in
+// bs.
+func NewMissingFrontier(bs cbor.IpldStore, root cid.Cid, opts ...Option) (*MissingFrontier, error) {
+	cfg := defaultConfig()
+	for _, opt := range opts {
+		if err := opt(cfg); err != nil {
+			return nil, err
+		}
+	}
+	return &MissingFrontier{
+		bs:   cfg.wrapStore(bs, nil),
+		lc:   newLoadChecker(cfg),
+		root: root,
+	}, nil
+}
+
+// Next reads the nodes returned by the previous call that are now in the
+// store, and everything below them that is too, returning the nodes still
+// missing in index order. Those not fetched since the previous call are
+// returned again. The first call starts from the root. Once every block of
+// the AMT is in the store, Next returns no nodes.
+func (f *MissingFrontier) Next(ctx context.Context) ([]MissingNode, error) {
+	var missing []MissingNode
+	report := func(m MissingNode) error {
+		missing = append(missing, m)
+		return nil
+	}
+
+	if !f.rootRead {
+		_, height, nd, err := loadRawRoot(ctx, f.bs, f.lc, f.root)
+		if isNotFound(err) {
+			return []MissingNode{{Cid: f.root, Height: -1, End: math.MaxUint64}}, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if err := walkAvailable(ctx, f.bs, f.lc, height, 0, nd, report); err != nil {
+			return nil, err
+		}
+		f.rootRead = true
+	} else {
+		for _, m := range f.next {
+			_, nd, err := loadRawNode(ctx, f.bs, f.lc, m.Cid, m.Height)
+			if isNotFound(err) {
+				missing = append(missing, m)
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			if err := walkAvailable(ctx, f.bs, f.lc, m.Height, m.Start, nd, report); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	f.next = missing
+	return missing, nil
+}
+
+// walkAvailable reads the nodes below n that are in bs, passing those that
+// aren't to missing.
+func walkAvailable(ctx context.Context, bs cbor.IpldStore, lc *loadChecker, height int, offset uint64, n *node, missing func(MissingNode) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if height == 0 {
+		return nil
+	}
+	subCount := nodesForHeight(lc.cfg.bitWidth, height)
+	for i, ln := range n.links {
+		if ln == nil {
+			continue
+		}
+		offs := offset + (uint64(i) * subCount)
+		_, subn, err := loadRawNode(ctx, bs, lc, ln.cid, height-1)
+		if isNotFound(err) {
+			if err := missing(newMissingNode(ln.cid, height-1, offs, subCount)); err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := walkAvailable(ctx, bs, lc, height-1, offs, subn, missing); err != nil {
+			return err
+		}
+	}
+	return nil
+}
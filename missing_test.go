@@ -0,0 +1,260 @@
+package amt
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"testing"
+
+	cbor "github.com/ipfs/go-ipld-cbor"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/stretchr/testify/require"
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+func TestForEachAvailable(t *testing.T) {
+	runTestWithBitWidths(t, bitWidths2to18, func(t *testing.T, opts ...Option) {
+		ctx := context.Background()
+		mock := newMockBlocks()
+		bs := cbor.NewCborStore(mock)
+
+		a, err := NewAMT(bs, opts...)
+		require.NoError(t, err)
+		var indexes []uint64
+		for i := uint64(0); i < 50; i++ {
+			indexes = append(indexes, i*100_000)
+			assertSet(t, a, i*100_000, "foo")
+		}
+		root, err := a.Flush(ctx)
+		require.NoError(t, err)
+		require.Positive(t, a.height)
+
+		// drop the first child of the root that doesn't cover index 0
+		var dropped NodeInfo
+		require.NoError(t, WalkNodes(ctx, bs, root, func(info NodeInfo) error {
+			if !dropped.Cid.Defined() && info.Height == a.height-1 && info.Offset > 0 {
+				dropped = info
+			}
+			return nil
+		}, opts...))
+		require.True(t, dropped.Cid.Defined())
+		delete(mock.data, dropped.Cid)
+
+		a, err = LoadAMT(ctx, bs, root, opts...)
+		require.NoError(t, err)
+		err = a.ForEach(ctx, func(uint64, *cbg.Deferred) error { return nil })
+		require.True(t, ipld.IsNotFound(err))
+
+		var visited []uint64
+		var missing []MissingNode
+		require.NoError(t, a.ForEachAvailable(ctx, 0, func(i uint64, _ *cbg.Deferred) error {
+			visited = append(visited, i)
+			return nil
+		}, func(m MissingNode) error {
+			missing = append(missing, m)
+			return nil
+		}))
+		require.Equal(t, []MissingNode{{
+			Cid:    dropped.Cid,
+			Height: dropped.Height,
+			Start:  dropped.Offset,
+			End:    spanEnd(dropped.Offset, dropped.Span),
+		}}, missing)
+		var expected []uint64
+		for _, i := range indexes {
+			if i < missing[0].Start || i >= missing[0].End {
+				expected = append(expected, i)
+			}
+		}
+		require.Less(t, len(expected), len(indexes))
+		require.Equal(t, expected, visited)
+
+		// iterating from past the missing node doesn't report it
+		missing = nil
+		require.NoError(t, a.ForEachAvailable(ctx, dropped.Offset+dropped.Span, func(uint64, *cbg.Deferred) error {
+			return nil
+		}, func(m MissingNode) error {
+			missing = append(missing, m)
+			return nil
+		}))
+		require.Empty(t, missing)
+
+		// an error from missing stops the iteration
+		err = a.ForEachAvailable(ctx, 0, func(uint64, *cbg.Deferred) error {
+			return nil
+		}, func(MissingNode) error {
+			return errBudget
+		})
+		require.ErrorIs(t, err, errBudget)
+	})
+}
+
+func TestDiffAvailable(t *testing.T) {
+	runTestWithBitWidths(t, bitWidths2to18, func(t *testing.T, opts ...Option) {
+		ctx := context.Background()
+		mock := newMockBlocks()
+		bs := cbor.NewCborStore(mock)
+
+		a, err := NewAMT(bs, opts...)
+		require.NoError(t, err)
+		for i := uint64(0); i < 50; i++ {
+			assertSet(t, a, i*100_000, "foo")
+		}
+		prev, err := a.Flush(ctx)
+		require.NoError(t, err)
+		height := a.height
+
+		// change every value, and grow the AMT so that its new subtrees are
+		// only in cur
+		for i := uint64(0); i < 50; i++ {
+			assertSet(t, a, i*100_000, "bar")
+		}
+		for i := uint64(0); i < 50; i++ {
+			assertSet(t, a, 1<<40+i*100_000, "far")
+		}
+		cur, err := a.Flush(ctx)
+		require.NoError(t, err)
+		require.Greater(t, a.height, height)
+
+		all, err := Diff(ctx, bs, bs, prev, cur, opts...)
+		require.NoError(t, err)
+
+		// drop a changed node below prev's height and one that is only in cur
+		prevBlocks := blockSet(ctx, t, bs, prev, opts...)
+		var dropped []NodeInfo
+		require.NoError(t, WalkNodes(ctx, bs, cur, func(info NodeInfo) error {
+			if prevBlocks[info.Cid] || info.Offset == 0 {
+				return nil
+			}
+			if len(dropped) == 0 && info.Height == height-1 ||
+				len(dropped) == 1 && info.Offset >= 1<<40 && info.Height < height {
+				dropped = append(dropped, info)
+			}
+			return nil
+		}, opts...))
+		require.Len(t, dropped, 2)
+		for _, info := range dropped {
+			delete(mock.data, info.Cid)
+		}
+
+		_, err = Diff(ctx, bs, bs, prev, cur, opts...)
+		require.True(t, ipld.IsNotFound(err))
+
+		var missing []MissingNode
+		changes, err := DiffAvailable(ctx, bs, bs, prev, cur, func(m MissingNode) error {
+			missing = append(missing, m)
+			return nil
+		}, opts...)
+		require.NoError(t, err)
+
+		require.Len(t, missing, len(dropped))
+		for i, info := range dropped {
+			require.Equal(t, MissingNode{
+				Cid:    info.Cid,
+				Height: info.Height,
+				Start:  info.Offset,
+				End:    spanEnd(info.Offset, info.Span),
+			}, missing[i])
+		}
+		var expected []*Change
+		for _, ch := range all {
+			known := true
+			for _, m := range missing {
+				if ch.Key >= m.Start && ch.Key < m.End {
+					known = false
+				}
+			}
+			if known {
+				expected = append(expected, ch)
+			}
+		}
+		require.Less(t, len(expected), len(all))
+		require.Equal(t, expected, changes)
+
+		// an error from missing stops the diff
+		_, err = DiffAvailable(ctx, bs, bs, prev, cur, func(MissingNode) error {
+			return errBudget
+		}, opts...)
+		require.ErrorIs(t, err, errBudget)
+	})
+}
+
+func TestMissingBlocks(t *testing.T) {
+	runTestWithBitWidths(t, bitWidths2to18, func(t *testing.T, opts ...Option) {
+		ctx := context.Background()
+		src := newMockBlocks()
+		srcBs := cbor.NewCborStore(src)
+
+		a, err := NewAMT(srcBs, opts...)
+		require.NoError(t, err)
+		for i := uint64(0); i < 50; i++ {
+			assertSet(t, a, i*100_000, fmt.Sprint(i))
+		}
+		root, err := a.Flush(ctx)
+		require.NoError(t, err)
+		var nodes []NodeInfo
+		require.NoError(t, WalkNodes(ctx, srcBs, root, func(info NodeInfo) error {
+			nodes = append(nodes, info)
+			return nil
+		}, opts...))
+
+		// fetch the AMT into an empty store a round at a time
+		dst := newMockBlocks()
+		dstBs := cbor.NewCborStore(dst)
+		f, err := NewMissingFrontier(dstBs, root, opts...)
+		require.NoError(t, err)
+		missing, err := f.Next(ctx)
+		require.NoError(t, err)
+		require.Equal(t, []MissingNode{{Cid: root, Height: -1, End: math.MaxUint64}}, missing)
+
+		// nothing has been fetched, so the same is returned again
+		again, err := f.Next(ctx)
+		require.NoError(t, err)
+		require.Equal(t, missing, again)
+
+		fetched := 0
+		for round := 0; len(missing) > 0; round++ {
+			require.LessOrEqual(t, round, a.height+1)
+			for _, m := range missing {
+				if round > 0 {
+					require.Equal(t, a.height-round, m.Height)
+					require.Equal(t, spanEnd(m.Start, nodesForHeight(a.bitWidth, m.Height+1)), m.End)
+				}
+				require.NoError(t, dst.Put(ctx, src.data[m.Cid]))
+				fetched++
+			}
+			missing, err = f.Next(ctx)
+			require.NoError(t, err)
+		}
+		require.Len(t, nodes, fetched)
+
+		missing, err = MissingBlocks(ctx, dstBs, root, opts...)
+		require.NoError(t, err)
+		require.Empty(t, missing)
+
+		if a.height == 0 {
+			return
+		}
+
+		// drop a leaf, and every node above it bar the root
+		dropped := nodes[len(nodes)-1]
+		require.Zero(t, dropped.Height)
+		var top NodeInfo
+		for _, info := range nodes[1:] {
+			if info.Offset <= dropped.Offset && dropped.Offset < spanEnd(info.Offset, info.Span) {
+				if !top.Cid.Defined() {
+					top = info
+				}
+				delete(dst.data, info.Cid)
+			}
+		}
+		missing, err = MissingBlocks(ctx, dstBs, root, opts...)
+		require.NoError(t, err)
+		require.Equal(t, []MissingNode{{
+			Cid:    top.Cid,
+			Height: top.Height,
+			Start:  top.Offset,
+			End:    spanEnd(top.Offset, top.Span),
+		}}, missing)
+	})
+}
@@ -3,7 +3,6 @@ package amt
 import (
 	"bytes"
 	"context"
-	"errors"
 	"fmt"
 
 	"github.com/ipfs/go-cid"
@@ -23,15 +22,6 @@ type node struct {
 	values []*cbg.Deferred
 }
 
-var (
-	errEmptyNode      = errors.New("unexpected empty amt node")
-	errUndefinedCID   = errors.New("amt node has undefined CID")
-	errLinksAndValues = errors.New("amt node has both links and values")
-	errLeafUnexpected = errors.New("amt leaf not expected at height")
-	errLeafExpected   = errors.New("amt expected at height")
-	errInvalidCount   = errors.New("amt count does not match number of elements")
-)
-
 // the number of bytes required such that there is a single bit for each element
 // in the links or value array. This is (bitWidth^2)/8.
 func bmapBytes(bitWidth uint) int {
@@ -48,12 +38,12 @@ func bmapBytes(bitWidth uint) int {
 func newNode(nd internal.Node, bitWidth uint, allowEmpty, expectLeaf bool) (*node, error) {
 	if len(nd.Links) > 0 && len(nd.Values) > 0 {
 		// malformed AMT, a node cannot be both leaf and non-leaf
-		return nil, errLinksAndValues
+		return nil, malformedf("node has both links and values")
 	}
 
 	// strictly require the bitmap to be the correct size for the given bitWidth
 	if expWidth := bmapBytes(bitWidth); expWidth != len(nd.Bmap) {
-		return nil, fmt.Errorf(
+		return nil, malformedf(
 			"expected bitfield to be %d bytes long, found bitfield with %d bytes",
 			expWidth, len(nd.Bmap),
 		)
@@ -64,7 +54,7 @@ func newNode(nd internal.Node, bitWidth uint, allowEmpty, expectLeaf bool) (*nod
 	n := new(node)
 	if len(nd.Values) > 0 { // leaf node, height=0
 		if !expectLeaf {
-			return nil, errLeafUnexpected
+			return nil, malformedf("found values in a node above the leaves")
 		}
 		n.values = make([]*cbg.Deferred, width)
 		for x := uint(0); x < width; x++ {
@@ -74,7 +64,7 @@ func newNode(nd internal.Node, bitWidth uint, allowEmpty, expectLeaf bool) (*nod
 				if i >= len(nd.Values) {
 					// too many bits were set in the bitmap for the number of values
 					// available
-					return nil, fmt.Errorf("expected at least %d values, found %d", i+1, len(nd.Values))
+					return nil, malformedf("expected at least %d values, found %d", i+1, len(nd.Values))
 				}
 				n.values[x] = nd.Values[i]
 				i++
@@ -83,12 +73,12 @@ func newNode(nd internal.Node, bitWidth uint, allowEmpty, expectLeaf bool) (*nod
 		if i != len(nd.Values) {
 			// the number of bits set in the bitmap was not the same as the number of
 			// values in the array
-			return nil, fmt.Errorf("expected %d values, got %d", i, len(nd.Values))
+			return nil, malformedf("expected %d values, got %d", i, len(nd.Values))
 		}
 	} else if len(nd.Links) > 0 {
 		// non-leaf node, height>0
 		if expectLeaf {
-			return nil, errLeafExpected
+			return nil, malformedf("found links in a leaf")
 		}
 
 		n.links = make([]*link, width)
@@ -99,16 +89,16 @@ func newNode(nd internal.Node, bitWidth uint, allowEmpty, expectLeaf bool) (*nod
 				if i >= len(nd.Links) {
 					// too many bits were set in the bitmap for the number of values
 					// available
-					return nil, fmt.Errorf("expected at least %d links, found %d", i+1, len(nd.Links))
+					return nil, malformedf("expected at least %d links, found %d", i+1, len(nd.Links))
 				}
 				c := nd.Links[i]
 				if !c.Defined() {
-					return nil, errUndefinedCID
+					return nil, malformedf("node has undefined CID")
 				}
 				// TODO: check link hash function.
 				prefix := c.Prefix()
 				if prefix.Codec != cid.DagCBOR {
-					return nil, fmt.Errorf("internal amt nodes must be cbor, found %d", prefix.Codec)
+					return nil, malformedf("internal amt nodes must be cbor, found %d", prefix.Codec)
 				}
 				n.links[x] = &link{cid: c}
 				i++
@@ -117,10 +107,10 @@ func newNode(nd internal.Node, bitWidth uint, allowEmpty, expectLeaf bool) (*nod
 		if i != len(nd.Links) {
 			// the number of bits set in the bitmap was not the same as the number of
 			// values in the array
-			return nil, fmt.Errorf("expected %d links, got %d", i, len(nd.Links))
+			return nil, malformedf("expected %d links, got %d", i, len(nd.Links))
 		}
 	} else if !allowEmpty { // only THE empty AMT case can allow this
-		return nil, errEmptyNode
+		return nil, malformedf("unexpected empty node")
 	}
 	return n, nil
 }
@@ -295,6 +285,18 @@ func (n *node) delete(ctx context.Context, bs cbor.IpldStore, bitWidth uint, hei
 // and can only be determined by knowing how far a leaf node is removed from
 // the left-most leaf node.
 func (n *node) forEachAt(ctx context.Context, bs cbor.IpldStore, bitWidth uint, height int, start, offset uint64, cb func(uint64, *cbg.Deferred) error) error {
+	return n.forEachAvailable(ctx, bs, bitWidth, height, start, offset, cb, nil)
+}
+
+// forEachAvailable is forEachAt, but where missing is non-nil, subtrees whose
+// nodes aren't found in the store are passed to missing and skipped instead of
+// failing the walk.
+func (n *node) forEachAvailable(ctx context.Context, bs cbor.IpldStore, bitWidth uint, height int, start, offset uint64, cb func(uint64, *cbg.Deferred) error, missing func(MissingNode) error) error {
+	// Stop at node boundaries when cancelled, as a cached tree never waits on
+	// the store.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if height == 0 {
 		// height=0 means we're at leaf nodes and get to use our callback
 		for i, v := range n.values {
@@ -335,21 +337,24 @@ func (n *node) forEachAt(ctx context.Context, bs cbor.IpldStore, bitWidth uint,
 		}
 
 		subn, err := ln.load(ctx, bs, bitWidth, height-1)
-		if err != nil {
+		if missing != nil && isNotFound(err) {
+			if err := missing(newMissingNode(ln.cid, height-1, offs, subCount)); err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
 			return err
 		}
 
 		// recurse into the child node, providing 'offs' to tell it where it's
 		// located in the tree
-		if err := subn.forEachAt(ctx, bs, bitWidth, height-1, start, offs, cb); err != nil {
+		if err := subn.forEachAvailable(ctx, bs, bitWidth, height-1, start, offs, cb, missing); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-var errNoVals = fmt.Errorf("no values")
-
 // Recursive implementation of FirstSetIndex that's performed on the left-most
 // nodes of the tree down to the leaf. In order to return a correct index, we
 // need to accumulate the appropriate number of spaces to the left of the
@@ -365,7 +370,7 @@ func (n *node) firstSetIndex(ctx context.Context, bs cbor.IpldStore, bitWidth ui
 			}
 		}
 		// if we're here, we're either dealing with a malformed AMT or an empty AMT
-		return 0, errNoVals
+		return 0, ErrNoValues
 	}
 
 	// we're dealing with a non-leaf node
@@ -395,7 +400,7 @@ func (n *node) firstSetIndex(ctx context.Context, bs cbor.IpldStore, bitWidth ui
 		return ix + (uint64(i) * subCount), nil
 	}
 
-	return 0, errNoVals
+	return 0, ErrNoValues
 }
 
 // Recursive implementation of the set operation that calls through child nodes
@@ -449,6 +454,38 @@ func (n *node) set(ctx context.Context, bs cbor.IpldStore, bitWidth uint, height
 // flush() on each child node. It generates the serialized form of this node,
 // which includes the bitmap and compacted links or values array.
 func (n *node) flush(ctx context.Context, bs cbor.IpldStore, bitWidth uint, height int) (*internal.Node, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if height > 0 {
+		// non-leaf node, save any dirty children so we can link to them
+		for _, ln := range n.links {
+			if ln == nil || !ln.dirty {
+				continue
+			}
+			if ln.cached == nil {
+				return nil, fmt.Errorf("expected dirty node to be cached")
+			}
+			subn, err := ln.cached.flush(ctx, bs, bitWidth, height-1)
+			if err != nil {
+				return nil, err
+			}
+			c, err := bs.Put(ctx, subn)
+			if err != nil {
+				return nil, err
+			}
+
+			ln.cid = c
+			ln.dirty = false
+		}
+	}
+
+	return n.compact(bitWidth, height)
+}
+
+// compact generates the serialized form of this node without saving anything,
+// so all of its links must already be flushed.
+func (n *node) compact(bitWidth uint, height int) (*internal.Node, error) {
 	nd := new(internal.Node)
 	nd.Bmap = make([]byte, bmapBytes(bitWidth))
 
@@ -471,20 +508,7 @@ func (n *node) flush(ctx context.Context, bs cbor.IpldStore, bitWidth uint, heig
 			continue
 		}
 		if ln.dirty {
-			if ln.cached == nil {
-				return nil, fmt.Errorf("expected dirty node to be cached")
-			}
-			subn, err := ln.cached.flush(ctx, bs, bitWidth, height-1)
-			if err != nil {
-				return nil, err
-			}
-			c, err := bs.Put(ctx, subn)
-			if err != nil {
-				return nil, err
-			}
-
-			ln.cid = c
-			ln.dirty = false
+			return nil, fmt.Errorf("amt node has unflushed changes")
 		}
 		nd.Links = append(nd.Links, ln.cid)
 		// set the bit in the bitmap for this position to indicate its presence
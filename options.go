@@ -2,14 +2,35 @@ package amt
 
 import (
 	"fmt"
+	"math"
 )
 
 var defaultBitWidth = uint(3)
 
+// noLimit is the value of a limit that hasn't been set.
+const noLimit = math.MaxUint64
+
 type config struct {
-	bitWidth uint
+	bitWidth        uint
+	strictCanonical bool
+	meter           Meter
+	tracer          Tracer
+	traceCounter    *traceCounter // shared by the AMTs of a traced diff
+
+	// Limits on reading an AMT, noLimit where unset. limited is set where any
+	// of them is.
+	limited        bool
+	maxBitWidth    uint64
+	maxHeight      uint64
+	maxNodeBytes   uint64
+	maxValueBytes  uint64
+	maxNodesLoaded uint64
 }
 
+// Option configures how an AMT is built or read. Functions that read an AMT
+// from its root CID, such as Diff, WalkNodes, ExportCAR, Copy and VerifyProof,
+// check its blocks with the same rules as LoadAMT, so they must be given the
+// options the AMT is loaded with, in particular its bit width.
 type Option func(*config) error
 
 func UseTreeBitWidth(bitWidth uint) Option {
@@ -22,8 +43,99 @@ func UseTreeBitWidth(bitWidth uint) Option {
 	}
 }
 
+// StrictCanonical rejects AMTs that aren't exactly as this library would have
+// built them, which matters where AMTs are compared or hashed for consensus.
+// Each root and node is re-encoded and compared with its stored bytes as it is
+// loaded, and a root with a height greater than needed for its links is
+// rejected. Values are opaque and are not checked.
+func StrictCanonical() Option {
+	return func(c *config) error {
+		c.strictCanonical = true
+		return nil
+	}
+}
+
+// UseMeter installs m to be told about every block read from or written to the
+// store. Only one Meter can be installed; the last one given is used.
+func UseMeter(m Meter) Option {
+	return func(c *config) error {
+		c.meter = m
+		return nil
+	}
+}
+
+// MaxBitWidth rejects AMTs with a bit width greater than max when they are
+// read. See LimitError.
+func MaxBitWidth(max uint) Option {
+	return func(c *config) error {
+		c.limited = true
+		c.maxBitWidth = uint64(max)
+		return nil
+	}
+}
+
+// MaxHeight rejects AMTs with a height greater than max when they are read.
+// See LimitError.
+func MaxHeight(max int) Option {
+	return func(c *config) error {
+		if max < 0 {
+			return fmt.Errorf("max height must not be negative, is %d", max)
+		}
+		c.limited = true
+		c.maxHeight = uint64(max)
+		return nil
+	}
+}
+
+// MaxNodeBytes rejects root and node blocks larger than max bytes as they are
+// read. See LimitError.
+func MaxNodeBytes(max int) Option {
+	return func(c *config) error {
+		if max < 1 {
+			return fmt.Errorf("max node bytes must be at least 1, is %d", max)
+		}
+		c.limited = true
+		c.maxNodeBytes = uint64(max)
+		return nil
+	}
+}
+
+// MaxValueBytes rejects serialized values larger than max bytes as the nodes
+// holding them are read. See LimitError.
+func MaxValueBytes(max int) Option {
+	return func(c *config) error {
+		if max < 1 {
+			return fmt.Errorf("max value bytes must be at least 1, is %d", max)
+		}
+		c.limited = true
+		c.maxValueBytes = uint64(max)
+		return nil
+	}
+}
+
+// MaxNodesLoaded limits the number of root and node blocks read from the
+// store for an AMT, counting from LoadAMT over the life of the returned Root,
+// or over a single call of functions such as Diff or ExportCAR. Each side of a
+// diff has its own count. Nodes already cached in memory aren't counted. See
+// LimitError.
+func MaxNodesLoaded(max int) Option {
+	return func(c *config) error {
+		if max < 1 {
+			return fmt.Errorf("max nodes loaded must be at least 1, is %d", max)
+		}
+		c.limited = true
+		c.maxNodesLoaded = uint64(max)
+		return nil
+	}
+}
+
 func defaultConfig() *config {
 	return &config{
-		bitWidth: defaultBitWidth,
+		bitWidth:       defaultBitWidth,
+		maxBitWidth:    noLimit,
+		maxHeight:      noLimit,
+		maxNodeBytes:   noLimit,
+		maxValueBytes:  noLimit,
+		maxNodesLoaded: noLimit,
 	}
 }
@@ -0,0 +1,475 @@
+package amt
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/ipfs/go-cid"
+	cbg "github.com/whyrusleeping/cbor-gen"
+
+	"github.com/filecoin-project/go-amt-ipld/v4/internal"
+)
+
+// Proof holds the blocks needed to verify the contents of an AMT without
+// access to a store. See Root.Prove, Root.ProveAbsent and their verifiers.
+//
+// A Proof is serialized as internal.Proof using MarshalCBOR.
+type Proof struct {
+	// Root is the serialized root block of the AMT.
+	Root []byte
+	// Nodes are the serialized node blocks below the root that the proof
+	// needs, in depth-first order. For a single index this is the path from
+	// just below the root down to the leaf.
+	Nodes [][]byte
+}
+
+func (p *Proof) MarshalCBOR(w io.Writer) error {
+	ip := internal.Proof{Root: p.Root, Nodes: p.Nodes}
+	return ip.MarshalCBOR(w)
+}
+
+func (p *Proof) UnmarshalCBOR(r io.Reader) error {
+	var ip internal.Proof
+	if err := ip.UnmarshalCBOR(r); err != nil {
+		return err
+	}
+	*p = Proof{Root: ip.Root, Nodes: ip.Nodes}
+	return nil
+}
+
+// Prove returns a proof that index i is set in this AMT, which can be checked
+// with VerifyProof against the AMT's root CID. The proof holds the serialized
+// root and the nodes on the path from the root to the leaf holding i.
+//
+// The AMT must not have unflushed changes, and an error is returned if i is
+// not set.
+func (r *Root) Prove(ctx context.Context, i uint64) (*Proof, error) {
+	proof, found, err := r.provePath(ctx, i)
+	if err != nil {
+		return nil, err
+	} else if !found {
+		return nil, fmt.Errorf("%w: %d", ErrNotFound, i)
+	}
+	return proof, nil
+}
+
+// ProveAbsent returns a proof that index i is not set in this AMT, which can
+// be checked with VerifyAbsent against the AMT's root CID. The proof holds the
+// serialized root and the nodes on the path toward i, down to the node that
+// has no link or value in the slot for i. Where i is beyond the range the
+// root's height can address, the root alone is the proof.
+//
+// The AMT must not have unflushed changes, and an error is returned if i is
+// set.
+func (r *Root) ProveAbsent(ctx context.Context, i uint64) (*Proof, error) {
+	proof, found, err := r.provePath(ctx, i)
+	if err != nil {
+		return nil, err
+	} else if found {
+		return nil, fmt.Errorf("index %d is set", i)
+	}
+	return proof, nil
+}
+
+// provePath builds a proof from the root toward index i, stopping where the
+// path ends, and returns whether i is set.
+func (r *Root) provePath(ctx context.Context, i uint64) (*Proof, bool, error) {
+	if i > MaxIndex {
+		return nil, false, indexOutOfRange(i)
+	}
+
+	proof, err := r.newProof(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if i >= nodesForHeight(r.bitWidth, r.height+1) {
+		return proof, false, nil
+	}
+
+	n := r.node
+	for height := r.height; height > 0; height-- {
+		nfh := nodesForHeight(r.bitWidth, height)
+		ln := n.getLink(i / nfh)
+		if ln == nil {
+			return proof, false, nil
+		}
+		if n, err = proof.addLink(ctx, r, ln, height-1); err != nil {
+			return nil, false, err
+		}
+		i %= nfh
+	}
+
+	return proof, n.getValue(i) != nil, nil
+}
+
+// newProof starts a proof holding the root block. Where the AMT was loaded or
+// flushed, the block is read back from the store rather than re-encoded, so
+// that it hashes to the root CID whatever encoding the store holds.
+func (r *Root) newProof(ctx context.Context) (*Proof, error) {
+	if !r.cid.Defined() {
+		data, err := r.encode()
+		if err != nil {
+			return nil, err
+		}
+		return &Proof{Root: data}, nil
+	}
+	b, err := getRawBlock(ctx, r.store, r.cid)
+	if err != nil {
+		return nil, err
+	}
+	return &Proof{Root: b.data}, nil
+}
+
+// addLink loads the node at height behind ln and appends its block to the
+// proof. The block is appended as stored rather than re-encoded, so that it
+// hashes to ln's CID whatever encoding the store holds.
+func (p *Proof) addLink(ctx context.Context, r *Root, ln *link, height int) (*node, error) {
+	if ln.dirty {
+		return nil, fmt.Errorf("amt node has unflushed changes")
+	}
+	b, err := getRawBlock(ctx, r.store, ln.cid)
+	if err != nil {
+		return nil, err
+	}
+	// r.store only counts and sizes raw reads, so apply the rest of the checks
+	// the AMT was loaded with as its nodes are when loaded.
+	if lc := storeChecker(r.store); lc != nil {
+		if err := lc.nodeContents(b.data); err != nil {
+			return nil, blockError(err, ln.cid, height)
+		}
+	}
+	n, err := decodeNode(ln.cid, b.data, r.bitWidth, height)
+	if err != nil {
+		return nil, err
+	}
+	p.Nodes = append(p.Nodes, b.data)
+	return n, nil
+}
+
+// VerifyProof checks a proof produced by Root.Prove against the root CID of
+// an AMT and returns the value at index i. Every block in the proof is hashed
+// and checked against the CID that links to it.
+func VerifyProof(rootCid cid.Cid, i uint64, proof *Proof, opts ...Option) (*cbg.Deferred, error) {
+	v, err := verifyPath(rootCid, i, proof, opts...)
+	if err != nil {
+		return nil, err
+	} else if v == nil {
+		return nil, fmt.Errorf("proof shows index %d is not set", i)
+	}
+	return v, nil
+}
+
+// VerifyAbsent checks a proof produced by Root.ProveAbsent against the root
+// CID of an AMT, returning nil if it shows that index i is not set. Blocks are
+// checked in the same way as VerifyProof.
+func VerifyAbsent(rootCid cid.Cid, i uint64, proof *Proof, opts ...Option) error {
+	v, err := verifyPath(rootCid, i, proof, opts...)
+	if err != nil {
+		return err
+	} else if v != nil {
+		return fmt.Errorf("proof shows index %d is set", i)
+	}
+	return nil
+}
+
+// verifyPath follows the path toward index i through the blocks of the proof
+// and returns the value at i, or nil if the path shows that i is not set.
+func verifyPath(rootCid cid.Cid, i uint64, proof *Proof, opts ...Option) (*cbg.Deferred, error) {
+	if i > MaxIndex {
+		return nil, indexOutOfRange(i)
+	}
+
+	pr, err := newProofReader(rootCid, proof, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	// the height of the root rules out the index
+	if i >= nodesForHeight(pr.bitWidth, pr.height+1) {
+		return nil, pr.done()
+	}
+
+	n := pr.root
+	for height := pr.height; height > 0; height-- {
+		nfh := nodesForHeight(pr.bitWidth, height)
+		ln := n.getLink(i / nfh)
+		if ln == nil {
+			return nil, pr.done()
+		}
+		if n, err = pr.next(ln.cid, height-1); err != nil {
+			return nil, err
+		}
+		i %= nfh
+	}
+
+	return n.getValue(i), pr.done()
+}
+
+// proofReader verifies the blocks of a proof as they are consumed.
+type proofReader struct {
+	lc       *loadChecker
+	proof    *Proof
+	used     int
+	bitWidth uint
+	height   int
+	count    uint64
+	root     *node
+}
+
+// newProofReader checks the root block of the proof against rootCid and
+// expands its node.
+func newProofReader(rootCid cid.Cid, proof *Proof, opts ...Option) (*proofReader, error) {
+	cfg := defaultConfig()
+	for _, opt := range opts {
+		if err := opt(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := internal.CheckBlock(rootCid, proof.Root); err != nil {
+		return nil, err
+	}
+	var r internal.Root
+	if err := r.UnmarshalCBOR(bytes.NewReader(proof.Root)); err != nil {
+		return nil, withBlock(malformedf("decoding root: %w", err), rootCid, -1)
+	}
+	if err := checkRoot(&r, cfg); err != nil {
+		return nil, withBlock(err, rootCid, int(r.Height))
+	}
+	lc := newLoadChecker(cfg)
+	if err := lc.root(proof.Root); err != nil {
+		return nil, blockError(err, rootCid, int(r.Height))
+	}
+	nd, err := newNode(r.Node, cfg.bitWidth, r.Height == 0, r.Height == 0)
+	if err != nil {
+		return nil, withBlock(err, rootCid, int(r.Height))
+	}
+
+	return &proofReader{
+		lc:       lc,
+		proof:    proof,
+		bitWidth: cfg.bitWidth,
+		height:   int(r.Height),
+		count:    r.Count,
+		root:     nd,
+	}, nil
+}
+
+// next consumes the next node block of the proof, which must be the block
+// linked to by c, and expands it as a node at the given height.
+func (pr *proofReader) next(c cid.Cid, height int) (*node, error) {
+	if pr.used >= len(pr.proof.Nodes) {
+		return nil, fmt.Errorf("proof is missing node %s", c)
+	}
+	data := pr.proof.Nodes[pr.used]
+	pr.used++
+
+	if err := internal.CheckBlock(c, data); err != nil {
+		return nil, err
+	}
+	if err := pr.lc.node(data); err != nil {
+		return nil, blockError(err, c, height)
+	}
+	return decodeNode(c, data, pr.bitWidth, height)
+}
+
+// done checks that every block of the proof was used.
+func (pr *proofReader) done() error {
+	if pr.used != len(pr.proof.Nodes) {
+		return fmt.Errorf("proof has %d unexpected nodes", len(pr.proof.Nodes)-pr.used)
+	}
+	return nil
+}
+
+// ProvenValue is an index and its value, as shown by a proof.
+type ProvenValue struct {
+	Index uint64
+	Value *cbg.Deferred
+}
+
+// ProveMany returns a single proof of whether each of the given indexes is
+// set, which can be checked with VerifyMany. The proof holds each block on the
+// paths toward the indexes once, so shared upper nodes aren't repeated.
+//
+// The AMT must not have unflushed changes.
+func (r *Root) ProveMany(ctx context.Context, indices []uint64) (*Proof, error) {
+	wants, err := wantIndices(indices)
+	if err != nil {
+		return nil, err
+	}
+	return r.proveWhere(ctx, wants)
+}
+
+// ProveRange returns a proof of every index set in the range [start, end),
+// which can be checked with VerifyRange. The proof holds every node whose
+// range of indexes overlaps [start, end), which also shows that no other
+// indexes in the range are set.
+//
+// The AMT must not have unflushed changes.
+func (r *Root) ProveRange(ctx context.Context, start, end uint64) (*Proof, error) {
+	return r.proveWhere(ctx, wantRange(start, end))
+}
+
+// VerifyMany checks a proof produced by Root.ProveMany for the same indexes
+// against the root CID of an AMT, and returns the indexes that are set with
+// their values, in ascending order. Indexes that are not returned are proven
+// not to be set. Blocks are checked in the same way as VerifyProof.
+func VerifyMany(rootCid cid.Cid, indices []uint64, proof *Proof, opts ...Option) ([]ProvenValue, error) {
+	wants, err := wantIndices(indices)
+	if err != nil {
+		return nil, err
+	}
+	return verifyWhere(rootCid, proof, wants, opts...)
+}
+
+// VerifyRange checks a proof produced by Root.ProveRange for the same range
+// against the root CID of an AMT, and returns every index set in [start, end)
+// with its value, in ascending order. Blocks are checked in the same way as
+// VerifyProof.
+func VerifyRange(rootCid cid.Cid, start, end uint64, proof *Proof, opts ...Option) ([]ProvenValue, error) {
+	return verifyWhere(rootCid, proof, wantRange(start, end), opts...)
+}
+
+// Size returns the number of bytes in the serialized form of the proof.
+func (p *Proof) Size() int {
+	var cw countWriter
+	if err := p.MarshalCBOR(&cw); err != nil {
+		return 0
+	}
+	return int(cw)
+}
+
+type countWriter int
+
+func (cw *countWriter) Write(b []byte) (int, error) {
+	*cw += countWriter(len(b))
+	return len(b), nil
+}
+
+// wantFunc decides whether a proof needs the subtree holding the indexes in
+// [lo, hi).
+type wantFunc func(lo, hi uint64) bool
+
+// wantIndices returns a wantFunc that selects the subtrees holding any of
+// the given indexes.
+func wantIndices(indices []uint64) (wantFunc, error) {
+	sorted := append([]uint64(nil), indices...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	for _, i := range sorted {
+		if i > MaxIndex {
+			return nil, indexOutOfRange(i)
+		}
+	}
+	return func(lo, hi uint64) bool {
+		j := sort.Search(len(sorted), func(j int) bool { return sorted[j] >= lo })
+		return j < len(sorted) && sorted[j] < hi
+	}, nil
+}
+
+// wantRange returns a wantFunc that selects the subtrees overlapping
+// [start, end).
+func wantRange(start, end uint64) wantFunc {
+	return func(lo, hi uint64) bool {
+		return lo < end && start < hi
+	}
+}
+
+// spanEnd returns the exclusive end of the span of count indexes starting at
+// offset, saturating rather than overflowing.
+func spanEnd(offset, count uint64) uint64 {
+	if end := offset + count; end >= offset {
+		return end
+	}
+	return math.MaxUint64
+}
+
+// proveWhere builds a proof holding every node selected by wants, in
+// depth-first order.
+func (r *Root) proveWhere(ctx context.Context, wants wantFunc) (*Proof, error) {
+	proof, err := r.newProof(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := proof.addSubtrees(ctx, r, r.node, r.height, 0, wants); err != nil {
+		return nil, err
+	}
+	return proof, nil
+}
+
+func (p *Proof) addSubtrees(ctx context.Context, r *Root, n *node, height int, offset uint64, wants wantFunc) error {
+	if height == 0 {
+		return nil
+	}
+	subCount := nodesForHeight(r.bitWidth, height)
+	for i, ln := range n.links {
+		if ln == nil {
+			continue
+		}
+		offs := offset + (uint64(i) * subCount)
+		if !wants(offs, spanEnd(offs, subCount)) {
+			continue
+		}
+		subn, err := p.addLink(ctx, r, ln, height-1)
+		if err != nil {
+			return err
+		}
+		if err := p.addSubtrees(ctx, r, subn, height-1, offs, wants); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyWhere walks the nodes selected by wants through the blocks of the
+// proof, in the same order as proveWhere, and returns the values selected by
+// wants.
+func verifyWhere(rootCid cid.Cid, proof *Proof, wants wantFunc, opts ...Option) ([]ProvenValue, error) {
+	pr, err := newProofReader(rootCid, proof, opts...)
+	if err != nil {
+		return nil, err
+	}
+	var values []ProvenValue
+	if err := pr.collect(pr.root, pr.height, 0, wants, &values); err != nil {
+		return nil, err
+	}
+	if err := pr.done(); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+func (pr *proofReader) collect(n *node, height int, offset uint64, wants wantFunc, values *[]ProvenValue) error {
+	if height == 0 {
+		for i, v := range n.values {
+			ix := offset + uint64(i)
+			if v != nil && wants(ix, ix+1) {
+				*values = append(*values, ProvenValue{Index: ix, Value: v})
+			}
+		}
+		return nil
+	}
+
+	subCount := nodesForHeight(pr.bitWidth, height)
+	for i, ln := range n.links {
+		if ln == nil {
+			continue
+		}
+		offs := offset + (uint64(i) * subCount)
+		if !wants(offs, spanEnd(offs, subCount)) {
+			continue
+		}
+		subn, err := pr.next(ln.cid, height-1)
+		if err != nil {
+			return err
+		}
+		if err := pr.collect(subn, height-1, offs, wants, values); err != nil {
+			return err
+		}
+	}
+	return nil
+}
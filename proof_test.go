@@ -0,0 +1,250 @@
+package amt
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/stretchr/testify/require"
+	cbg "github.com/whyrusleeping/cbor-gen"
+
+	"github.com/filecoin-project/go-amt-ipld/v4/internal"
+)
+
+func TestProve(t *testing.T) {
+	runTestWithBitWidths(t, bitWidths2to18, func(t *testing.T, opts ...Option) {
+		ctx := context.Background()
+		bs := cbor.NewCborStore(newMockBlocks())
+
+		a, err := NewAMT(bs, opts...)
+		require.NoError(t, err)
+		indexes := []uint64{0, 7, 100, 5000, 1 << 30}
+		for _, i := range indexes {
+			assertSet(t, a, i, "value")
+		}
+		c, err := a.Flush(ctx)
+		require.NoError(t, err)
+
+		for _, i := range indexes {
+			proof, err := a.Prove(ctx, i)
+			require.NoError(t, err)
+			require.Len(t, proof.Nodes, a.height)
+
+			// round trip the proof through its serialized form
+			var buf bytes.Buffer
+			require.NoError(t, proof.MarshalCBOR(&buf))
+			var decoded Proof
+			require.NoError(t, decoded.UnmarshalCBOR(&buf))
+			require.Equal(t, proof, &decoded)
+
+			v, err := VerifyProof(c, i, &decoded, opts...)
+			require.NoError(t, err)
+			var out CborByteArray
+			require.NoError(t, out.UnmarshalCBOR(bytes.NewReader(v.Raw)))
+			require.Equal(t, "value", string(out))
+
+			// the proof is only valid for its own index and root
+			_, err = VerifyProof(c, i+1, proof, opts...)
+			require.Error(t, err)
+		}
+
+		_, err = a.Prove(ctx, 1)
+		require.Error(t, err)
+
+		// tampering with any block invalidates the proof
+		proof, err := a.Prove(ctx, 5000)
+		require.NoError(t, err)
+		for n := range proof.Nodes {
+			tampered := &Proof{Root: proof.Root, Nodes: append([][]byte(nil), proof.Nodes...)}
+			tampered.Nodes[n] = append([]byte(nil), tampered.Nodes[n]...)
+			tampered.Nodes[n][len(tampered.Nodes[n])-1] ^= 1
+			_, err = VerifyProof(c, 5000, tampered, opts...)
+			require.Error(t, err)
+		}
+		_, err = VerifyProof(c, 5000, &Proof{Root: proof.Root, Nodes: proof.Nodes[1:]}, opts...)
+		require.Error(t, err)
+
+		// unflushed changes can't be proven
+		assertSet(t, a, 5001, "value")
+		_, err = a.Prove(ctx, 5000)
+		require.Error(t, err)
+	})
+}
+
+func TestProveNonCanonicalNode(t *testing.T) {
+	ctx := context.Background()
+	bs := cbor.NewCborStore(newMockBlocks())
+	value := &cbg.Deferred{Raw: []byte{0x61, 0x61}}
+
+	// A leaf with bits set beyond the width of its bitmap is accepted by
+	// LoadAMT, but isn't how this library would encode it.
+	leaf := putEncoded(ctx, t, bs, &internal.Node{Bmap: []byte{0x05}, Values: []*cbg.Deferred{value}})
+	other := putEncoded(ctx, t, bs, &internal.Node{Bmap: []byte{0x01}, Values: []*cbg.Deferred{value}})
+	root := putEncoded(ctx, t, bs, &internal.Root{
+		BitWidth: 1,
+		Height:   1,
+		Count:    2,
+		Node:     internal.Node{Bmap: []byte{0x03}, Links: []cid.Cid{leaf, other}},
+	})
+
+	a, err := LoadAMT(ctx, bs, root, UseTreeBitWidth(1))
+	require.NoError(t, err)
+	proof, err := a.Prove(ctx, 0)
+	require.NoError(t, err)
+	v, err := VerifyProof(root, 0, proof, UseTreeBitWidth(1))
+	require.NoError(t, err)
+	require.Equal(t, value.Raw, v.Raw)
+
+	// the checks the AMT was loaded with still apply to the nodes read raw
+	a, err = LoadAMT(ctx, bs, root, UseTreeBitWidth(1), StrictCanonical())
+	require.NoError(t, err)
+	_, err = a.Prove(ctx, 0)
+	require.ErrorIs(t, err, ErrMalformed)
+}
+
+func TestProveNonCanonicalRoot(t *testing.T) {
+	ctx := context.Background()
+	bs := cbor.NewCborStore(newMockBlocks())
+	value := &cbg.Deferred{Raw: []byte{0x61, 0x61}}
+
+	root := putEncoded(ctx, t, bs, &internal.Root{
+		BitWidth: 1,
+		Height:   0,
+		Count:    1,
+		Node:     internal.Node{Bmap: []byte{0x05}, Values: []*cbg.Deferred{value}},
+	})
+
+	a, err := LoadAMT(ctx, bs, root, UseTreeBitWidth(1))
+	require.NoError(t, err)
+	for _, prove := range []func() (*Proof, error){
+		func() (*Proof, error) { return a.Prove(ctx, 0) },
+		func() (*Proof, error) { return a.ProveRange(ctx, 0, 2) },
+	} {
+		proof, err := prove()
+		require.NoError(t, err)
+		vals, err := VerifyRange(root, 0, 2, proof, UseTreeBitWidth(1))
+		require.NoError(t, err)
+		require.Equal(t, []ProvenValue{{Index: 0, Value: value}}, vals)
+	}
+
+	// once modified, the root is proven as it would be flushed
+	assertSet(t, a, 1, "foo")
+	proof, err := a.Prove(ctx, 1)
+	require.NoError(t, err)
+	c, err := a.Flush(ctx)
+	require.NoError(t, err)
+	_, err = VerifyProof(c, 1, proof, UseTreeBitWidth(1))
+	require.NoError(t, err)
+}
+
+func TestProveAbsent(t *testing.T) {
+	runTestWithBitWidths(t, bitWidths2to18, func(t *testing.T, opts ...Option) {
+		ctx := context.Background()
+		bs := cbor.NewCborStore(newMockBlocks())
+
+		empty, err := NewAMT(bs, opts...)
+		require.NoError(t, err)
+		emptyCid, err := empty.Flush(ctx)
+		require.NoError(t, err)
+		proof, err := empty.ProveAbsent(ctx, 0)
+		require.NoError(t, err)
+		require.NoError(t, VerifyAbsent(emptyCid, 0, proof, opts...))
+
+		a, err := NewAMT(bs, opts...)
+		require.NoError(t, err)
+		assertSet(t, a, 0, "value")
+		assertSet(t, a, 5000, "value")
+		c, err := a.Flush(ctx)
+		require.NoError(t, err)
+
+		for _, i := range []uint64{
+			1,       // unset bit in a leaf bitmap
+			3000,    // missing link at some height
+			1 << 40, // beyond the range of the root's height
+			MaxIndex,
+		} {
+			proof, err := a.ProveAbsent(ctx, i)
+			require.NoError(t, err)
+			require.NoError(t, VerifyAbsent(c, i, proof, opts...))
+			_, err = VerifyProof(c, i, proof, opts...)
+			require.Error(t, err)
+		}
+
+		// the root alone can't prove absence of an index it can address
+		_, err = a.ProveAbsent(ctx, 5000)
+		require.Error(t, err)
+		proof, err = a.Prove(ctx, 5000)
+		require.NoError(t, err)
+		require.Error(t, VerifyAbsent(c, 5000, proof, opts...))
+		require.Error(t, VerifyAbsent(c, 5000, &Proof{Root: proof.Root}, opts...))
+	})
+}
+
+func TestProveManyAndRange(t *testing.T) {
+	runTestWithBitWidths(t, bitWidths2to18, func(t *testing.T, opts ...Option) {
+		ctx := context.Background()
+		bs := cbor.NewCborStore(newMockBlocks())
+
+		a, err := NewAMT(bs, opts...)
+		require.NoError(t, err)
+		for i := uint64(0); i < 2000; i += 3 {
+			assertSet(t, a, i, "value")
+		}
+		c, err := a.Flush(ctx)
+		require.NoError(t, err)
+
+		indices := []uint64{1500, 3, 4, 999, 1000, 1 << 40}
+		proof, err := a.ProveMany(ctx, indices)
+		require.NoError(t, err)
+
+		values, err := VerifyMany(c, indices, proof, opts...)
+		require.NoError(t, err)
+		var proven []uint64
+		for _, v := range values {
+			proven = append(proven, v.Index)
+		}
+		require.Equal(t, []uint64{3, 999, 1500}, proven)
+
+		// shared nodes are only included once
+		separate := 0
+		for _, i := range indices {
+			p, err := a.ProveMany(ctx, []uint64{i})
+			require.NoError(t, err)
+			separate += p.Size()
+		}
+		require.Less(t, proof.Size(), separate)
+
+		// the proof only verifies for the indexes it was made for
+		if a.height > 0 {
+			_, err = VerifyMany(c, []uint64{3, 999}, proof, opts...)
+			require.Error(t, err)
+		}
+
+		proof, err = a.ProveRange(ctx, 100, 200)
+		require.NoError(t, err)
+		var buf bytes.Buffer
+		require.NoError(t, proof.MarshalCBOR(&buf))
+		require.Equal(t, buf.Len(), proof.Size())
+
+		values, err = VerifyRange(c, 100, 200, proof, opts...)
+		require.NoError(t, err)
+		require.Len(t, values, 33)
+		for n, v := range values {
+			require.Equal(t, uint64(102+3*n), v.Index)
+		}
+
+		// omitting a node in the range is detected
+		if len(proof.Nodes) > 1 {
+			_, err = VerifyRange(c, 100, 200, &Proof{Root: proof.Root, Nodes: proof.Nodes[:len(proof.Nodes)-1]}, opts...)
+			require.Error(t, err)
+		}
+
+		proof, err = a.ProveRange(ctx, 5000, MaxIndex+1)
+		require.NoError(t, err)
+		values, err = VerifyRange(c, 5000, MaxIndex+1, proof, opts...)
+		require.NoError(t, err)
+		require.Empty(t, values)
+	})
+}
@@ -0,0 +1,241 @@
+package amt
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"math/bits"
+	"math/rand"
+
+	"github.com/filecoin-project/go-amt-ipld/v4/internal"
+)
+
+// Stats describes the shape of an AMT, as returned by Root.Stats and
+// Root.SampleStats.
+type Stats struct {
+	Height   int
+	BitWidth uint
+	Count    uint64
+
+	// Levels describes each level of the tree, indexed by height, so
+	// Levels[0] describes the leaves and Levels[Height] the root.
+	Levels []LevelStats
+
+	// ValueSizes is a histogram of the encoded sizes of values, where
+	// ValueSizes[k] counts the values whose size in bytes is k bits long,
+	// that is in [2^(k-1), 2^k).
+	ValueSizes []uint64
+
+	// MaxIndex is the highest index set, and Density is Count divided by
+	// the number of indexes up to and including it. Both are zero for an
+	// empty AMT.
+	MaxIndex uint64
+	Density  float64
+
+	// Sampled is set where only some of the leaves were visited, in which
+	// case the leaf counts, sizes and value histogram are estimates.
+	Sampled bool
+}
+
+// LevelStats describes the nodes at one height of an AMT.
+type LevelStats struct {
+	// Nodes is the number of nodes at this height.
+	Nodes uint64
+	// Slots is the number of links, or values for leaves, set in these
+	// nodes, and FillRatio the fraction of all their slots this represents.
+	Slots     uint64
+	FillRatio float64
+	// Bytes is the total encoded size of these nodes. The root node is
+	// counted as the whole root block.
+	Bytes uint64
+}
+
+// Stats walks the whole AMT and describes its shape. Nodes that aren't already
+// cached are loaded one at a time and dropped once visited, so the AMT can be
+// larger than memory. The AMT must not have unflushed changes.
+func (r *Root) Stats(ctx context.Context) (*Stats, error) {
+	return r.stats(ctx, 1, nil)
+}
+
+// SampleStats is like Stats, but only visits each leaf with probability
+// fraction, which must be in (0, 1]. Every other node is visited, which for
+// most bitwidths is a small part of the AMT. The figures for leaves and values
+// are estimated by scaling those of the sampled leaves, while the height,
+// count and maximum index remain exact. The sample is chosen with a
+// pseudo-random generator seeded with seed.
+func (r *Root) SampleStats(ctx context.Context, fraction float64, seed int64) (*Stats, error) {
+	if !(fraction > 0 && fraction <= 1) {
+		return nil, fmt.Errorf("sample fraction %v is not in (0, 1]", fraction)
+	}
+	return r.stats(ctx, fraction, rand.New(rand.NewSource(seed)))
+}
+
+func (r *Root) stats(ctx context.Context, fraction float64, rnd *rand.Rand) (*Stats, error) {
+	data, err := r.encode()
+	if err != nil {
+		return nil, err
+	}
+
+	sw := &statsWalker{
+		root:     r,
+		levels:   make([]levelTotals, r.height+1),
+		fraction: fraction,
+		rnd:      rnd,
+	}
+	if err := sw.visit(ctx, r.node, r.height, 1, len(data)); err != nil {
+		return nil, err
+	}
+
+	stats := &Stats{
+		Height:   r.height,
+		BitWidth: r.bitWidth,
+		Count:    r.count,
+		Levels:   make([]LevelStats, len(sw.levels)),
+		Sampled:  fraction < 1,
+	}
+	width := float64(uint64(1) << r.bitWidth)
+	for h, lt := range sw.levels {
+		ls := LevelStats{
+			Nodes: estimate(lt.nodes),
+			Slots: estimate(lt.slots),
+			Bytes: estimate(lt.bytes),
+		}
+		if lt.nodes > 0 {
+			ls.FillRatio = lt.slots / (lt.nodes * width)
+		}
+		stats.Levels[h] = ls
+	}
+	for _, n := range sw.sizes {
+		stats.ValueSizes = append(stats.ValueSizes, estimate(n))
+	}
+
+	if r.count > 0 {
+		if stats.MaxIndex, err = r.maxIndex(ctx); err != nil {
+			return nil, err
+		}
+		stats.Density = float64(r.count) / (float64(stats.MaxIndex) + 1)
+	}
+	return stats, nil
+}
+
+// estimate rounds a possibly scaled total to the nearest count.
+func estimate(v float64) uint64 {
+	return uint64(math.Round(v))
+}
+
+type levelTotals struct {
+	nodes, slots, bytes float64
+}
+
+// statsWalker accumulates the totals for Root.Stats, weighting each node by
+// the inverse of the probability it was sampled with.
+type statsWalker struct {
+	root     *Root
+	levels   []levelTotals
+	sizes    []float64
+	fraction float64
+	rnd      *rand.Rand
+}
+
+func (sw *statsWalker) visit(ctx context.Context, n *node, height int, weight float64, size int) error {
+	lt := &sw.levels[height]
+	lt.nodes += weight
+	lt.slots += weight * float64(n.slots())
+	lt.bytes += weight * float64(size)
+
+	if height == 0 {
+		for _, v := range n.values {
+			if v == nil {
+				continue
+			}
+			k := bits.Len(uint(len(v.Raw)))
+			for len(sw.sizes) <= k {
+				sw.sizes = append(sw.sizes, 0)
+			}
+			sw.sizes[k] += weight
+		}
+		return nil
+	}
+
+	for _, ln := range n.links {
+		if ln == nil {
+			continue
+		}
+		subWeight := weight
+		if height == 1 && sw.rnd != nil {
+			if sw.rnd.Float64() >= sw.fraction {
+				continue
+			}
+			subWeight /= sw.fraction
+		}
+		subn, size, err := sw.load(ctx, ln, height-1)
+		if err != nil {
+			return err
+		}
+		if err := sw.visit(ctx, subn, height-1, subWeight, size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// load returns the node behind ln and its encoded size, without caching it.
+func (sw *statsWalker) load(ctx context.Context, ln *link, height int) (*node, int, error) {
+	bitWidth := sw.root.bitWidth
+	if ln.cached != nil {
+		nd, err := ln.cached.compact(bitWidth, height)
+		if err != nil {
+			return nil, 0, err
+		}
+		data, err := cborToBytes(nd)
+		if err != nil {
+			return nil, 0, err
+		}
+		return ln.cached, len(data), nil
+	}
+
+	b, err := getRawBlock(ctx, sw.root.store, ln.cid)
+	if err != nil {
+		return nil, 0, err
+	}
+	var nd internal.Node
+	if err := nd.UnmarshalCBOR(bytes.NewReader(b.data)); err != nil {
+		return nil, 0, withBlock(malformedf("decoding node: %w", err), ln.cid, height)
+	}
+	n, err := newNode(nd, bitWidth, false, height == 0)
+	if err != nil {
+		return nil, 0, withBlock(err, ln.cid, height)
+	}
+	return n, len(b.data), nil
+}
+
+// maxIndex returns the highest index set in a non-empty AMT, following the
+// right-most link at each height.
+func (r *Root) maxIndex(ctx context.Context) (uint64, error) {
+	n := r.node
+	c := r.cid
+	offset := uint64(0)
+	for height := r.height; height > 0; height-- {
+		i := len(n.links) - 1
+		for i >= 0 && n.links[i] == nil {
+			i--
+		}
+		if i < 0 {
+			return 0, withBlock(malformedf("found no links in a node above the leaves"), c, height)
+		}
+		offset += uint64(i) * nodesForHeight(r.bitWidth, height)
+		ln := n.links[i]
+		var err error
+		if n, err = ln.loadShallow(ctx, r.store, r.bitWidth, height-1); err != nil {
+			return 0, err
+		}
+		c = ln.cid
+	}
+	for i := len(n.values) - 1; i >= 0; i-- {
+		if n.values[i] != nil {
+			return offset + uint64(i), nil
+		}
+	}
+	return 0, withBlock(malformedf("found no values in a leaf"), c, 0)
+}
@@ -0,0 +1,84 @@
+package amt
+
+import (
+	"context"
+	"testing"
+
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStats(t *testing.T) {
+	runTestWithBitWidths(t, bitWidths2to18, func(t *testing.T, opts ...Option) {
+		ctx := context.Background()
+		bs := cbor.NewCborStore(newMockBlocks())
+
+		a, err := NewAMT(bs, opts...)
+		require.NoError(t, err)
+		for i := uint64(0); i < 3000; i += 2 {
+			assertSet(t, a, i, "value")
+		}
+		c, err := a.Flush(ctx)
+		require.NoError(t, err)
+
+		// compare against a freshly loaded AMT, with nothing cached
+		b, err := LoadAMT(ctx, bs, c, opts...)
+		require.NoError(t, err)
+		stats, err := b.Stats(ctx)
+		require.NoError(t, err)
+
+		require.Equal(t, a.height, stats.Height)
+		require.Equal(t, a.bitWidth, stats.BitWidth)
+		require.Equal(t, uint64(1500), stats.Count)
+		require.Equal(t, uint64(2998), stats.MaxIndex)
+		require.InDelta(t, 0.5, stats.Density, 0.001)
+		require.False(t, stats.Sampled)
+
+		var nodes, bytes uint64
+		for _, ls := range stats.Levels {
+			nodes += ls.Nodes
+			bytes += ls.Bytes
+		}
+		var walked, walkedBytes uint64
+		require.NoError(t, WalkNodes(ctx, bs, c, func(info NodeInfo) error {
+			walked++
+			walkedBytes += uint64(info.Size)
+			return nil
+		}, opts...))
+		require.Equal(t, walked, nodes)
+		require.Equal(t, walkedBytes, bytes)
+		require.Equal(t, uint64(1500), stats.Levels[0].Slots)
+		require.Equal(t, uint64(1), stats.Levels[stats.Height].Nodes)
+
+		// every value is the same size
+		var values uint64
+		for _, n := range stats.ValueSizes {
+			values += n
+		}
+		require.Equal(t, uint64(1500), values)
+		require.Equal(t, values, stats.ValueSizes[len(stats.ValueSizes)-1])
+
+		// the same figures are found with the tree cached
+		cached, err := a.Stats(ctx)
+		require.NoError(t, err)
+		require.Equal(t, stats, cached)
+
+		sampled, err := b.SampleStats(ctx, 0.5, 1)
+		require.NoError(t, err)
+		require.True(t, sampled.Sampled)
+		require.Equal(t, stats.MaxIndex, sampled.MaxIndex)
+		if stats.Levels[0].Nodes > 100 {
+			require.InEpsilon(t, stats.Levels[0].Slots, sampled.Levels[0].Slots, 0.2)
+		}
+
+		_, err = b.SampleStats(ctx, 0, 1)
+		require.Error(t, err)
+
+		// unflushed changes can't be described
+		if a.height > 0 {
+			assertSet(t, a, 5, "value")
+			_, err = a.Stats(ctx)
+			require.Error(t, err)
+		}
+	})
+}
@@ -0,0 +1,170 @@
+package amt
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	cbg "github.com/whyrusleeping/cbor-gen"
+
+	"github.com/filecoin-project/go-amt-ipld/v4/internal"
+)
+
+// Meter is told about each block an AMT reads from or writes to its store, so
+// that IO can be charged for or counted. A Meter is installed with UseMeter.
+// Returning an error from any method stops the operation that caused the call,
+// returning the error unwrapped, which makes it possible to budget operations.
+// Methods may be called concurrently, e.g. by ParallelDiff.
+type Meter interface {
+	// OnGet is called after the block c of size bytes is read from the store.
+	OnGet(c cid.Cid, size int) error
+	// OnDecode is called after OnGet, before the block is decoded into a root
+	// or node. Blocks that are only copied, e.g. by Copy or ExportCAR, aren't
+	// decoded by the read, so aren't reported.
+	OnDecode(c cid.Cid, size int) error
+	// OnEncode is called after a root or node is encoded into size bytes,
+	// before it is written.
+	OnEncode(size int) error
+	// OnPut is called after the block c of size bytes is written to the store.
+	OnPut(c cid.Cid, size int) error
+}
+
+// wrapStore returns bs wrapped to apply the Meter and traceCounter set in cfg,
+// and the checks of lc if it's non-nil. bs is returned as-is where there's
+// nothing to apply.
+func (cfg *config) wrapStore(bs cbor.IpldStore, lc *loadChecker) cbor.IpldStore {
+	if lc != nil && !lc.enabled() {
+		lc = nil
+	}
+	if cfg.meter == nil && cfg.traceCounter == nil && lc == nil {
+		return bs
+	}
+	return &amtStore{IpldStore: bs, lc: lc, meter: cfg.meter, trace: cfg.traceCounter}
+}
+
+// storeChecker returns the loadChecker applied by bs, or nil where it applies
+// none.
+func storeChecker(bs cbor.IpldStore) *loadChecker {
+	if s, ok := bs.(*amtStore); ok {
+		return s.lc
+	}
+	return nil
+}
+
+// amtStore wraps the store of an AMT, reading every block as bytes first so
+// that it can be passed to the Meter, counted for tracing and checked before
+// it's decoded. Root and
+// node blocks are run through the loadChecker of an AMT loaded with
+// StrictCanonical or any of the limit options. Blocks read raw, as done by
+// AllCIDs and Stats, are only counted and checked for size.
+type amtStore struct {
+	cbor.IpldStore
+	lc    *loadChecker  // nil where nothing is checked
+	meter Meter         // nil where unmetered
+	trace *traceCounter // nil where untraced
+}
+
+func (s *amtStore) Get(ctx context.Context, c cid.Cid, out interface{}) error {
+	cu, ok := out.(cbg.CBORUnmarshaler)
+	if !ok {
+		return s.IpldStore.Get(ctx, c, out)
+	}
+
+	b, err := getRawBlock(ctx, s.IpldStore, c)
+	if err != nil {
+		return err
+	}
+	if s.trace != nil {
+		s.trace.nodesLoaded.Add(1)
+		s.trace.bytesRead.Add(uint64(len(b.data)))
+	}
+	if s.meter != nil {
+		if err := s.meter.OnGet(c, len(b.data)); err != nil {
+			return err
+		}
+	}
+
+	if raw, ok := out.(*rawBlock); ok {
+		if s.lc != nil {
+			if err := s.lc.block(b.data); err != nil {
+				return blockError(err, c, -1)
+			}
+		}
+		raw.cid, raw.data = b.cid, b.data
+		return nil
+	}
+
+	if s.lc != nil {
+		var check func([]byte) error
+		switch out.(type) {
+		case *internal.Root:
+			check = s.lc.root
+		case *internal.Node, *internal.ShallowNode:
+			check = s.lc.node
+		}
+		if check != nil {
+			if err := check(b.data); err != nil {
+				return blockError(err, c, -1)
+			}
+		}
+	}
+	if s.meter != nil {
+		if err := s.meter.OnDecode(c, len(b.data)); err != nil {
+			return err
+		}
+	}
+	if err := cu.UnmarshalCBOR(bytes.NewReader(b.data)); err != nil {
+		return withBlock(malformedf("decoding block: %w", err), c, -1)
+	}
+	return nil
+}
+
+func (s *amtStore) Put(ctx context.Context, v interface{}) (cid.Cid, error) {
+	if s.meter == nil && s.trace == nil {
+		return s.IpldStore.Put(ctx, v)
+	}
+
+	var data []byte
+	if raw, ok := v.(*rawBlock); ok {
+		data = raw.data
+	} else if cm, ok := v.(cbg.CBORMarshaler); ok {
+		encoded, err := cborToBytes(cm)
+		if err != nil {
+			return cid.Undef, err
+		}
+		if s.meter != nil {
+			if err := s.meter.OnEncode(len(encoded)); err != nil {
+				return cid.Undef, err
+			}
+		}
+		data = encoded
+		v = encodedValue(encoded)
+	} else {
+		return s.IpldStore.Put(ctx, v)
+	}
+
+	c, err := s.IpldStore.Put(ctx, v)
+	if err != nil {
+		return cid.Undef, err
+	}
+	if s.trace != nil {
+		s.trace.bytesWritten.Add(uint64(len(data)))
+	}
+	if s.meter != nil {
+		if err := s.meter.OnPut(c, len(data)); err != nil {
+			return cid.Undef, err
+		}
+	}
+	return c, nil
+}
+
+// encodedValue is a value that has already been encoded, so it isn't encoded
+// again when written. Unlike a rawBlock, the store decides its CID.
+type encodedValue []byte
+
+func (ev encodedValue) MarshalCBOR(w io.Writer) error {
+	_, err := w.Write(ev)
+	return err
+}
@@ -0,0 +1,189 @@
+package amt
+
+import (
+	"context"
+	"math"
+	"sync/atomic"
+
+	cbor "github.com/ipfs/go-ipld-cbor"
+)
+
+// Tracer starts a span around each public operation on an AMT, so that the
+// time taken and the work done can be reported to a tracing backend. A Tracer
+// is installed with UseTracer. Spans are started for Set, Get, Delete, Flush,
+// ForEach and ForEachAt on a Root, and for Diff and ParallelDiff. Operations
+// built on these, such as BatchSet, start a span for each call they make.
+type Tracer interface {
+	// Start starts a span for the operation op, e.g. "Set", returning the
+	// context the operation is to be run with.
+	Start(ctx context.Context, op string) (context.Context, Span)
+}
+
+// Span is the span of a single operation, started by a Tracer.
+type Span interface {
+	// End is called once the operation is complete, with the work it did and
+	// the error it returned, if any.
+	End(stats SpanStats, err error)
+}
+
+// SpanStats describes the work done by the operation of a Span. Where the
+// operation is run from within another, e.g. a Get from within a ForEach
+// callback, its work is included in that of the outer operation as well.
+type SpanStats struct {
+	// NodesLoaded is the number of root and node blocks read from the store.
+	NodesLoaded uint64
+	// CacheHits is the number of times a node was found already loaded.
+	CacheHits uint64
+	// BytesRead and BytesWritten are the sizes of the blocks read from and
+	// written to the store.
+	BytesRead, BytesWritten uint64
+	// MaxDepth is the number of levels below the root that were reached, 0
+	// where only the root node was used.
+	MaxDepth int
+}
+
+// UseTracer installs t to start a span around each public operation. See
+// Tracer.
+func UseTracer(t Tracer) Option {
+	return func(c *config) error {
+		c.tracer = t
+		return nil
+	}
+}
+
+// withTraceCounter makes the AMT count its work with tc, so the work done on
+// several AMTs, such as both sides of a diff, can be reported as one span.
+func withTraceCounter(tc *traceCounter) Option {
+	return func(c *config) error {
+		c.traceCounter = tc
+		return nil
+	}
+}
+
+// traceCounter counts the work done on one or more AMTs that have a Tracer.
+// Counts are only ever added to, so a span reports the difference between the
+// counts at its start and end. minHeight and topHeight track the lowest height
+// a node was used at and the greatest height of a root, and are reset by each
+// span.
+type traceCounter struct {
+	nodesLoaded, cacheHits  atomic.Uint64
+	bytesRead, bytesWritten atomic.Uint64
+	minHeight, topHeight    atomic.Int64
+}
+
+func newTraceCounter() *traceCounter {
+	tc := new(traceCounter)
+	tc.minHeight.Store(math.MaxInt64)
+	tc.topHeight.Store(-1)
+	return tc
+}
+
+// root notes the use of a root at the given height.
+func (tc *traceCounter) root(height int) {
+	for h := tc.topHeight.Load(); int64(height) > h; h = tc.topHeight.Load() {
+		if tc.topHeight.CompareAndSwap(h, int64(height)) {
+			return
+		}
+	}
+}
+
+// node notes the use of a node at the given height, which was found already
+// loaded where cached is true.
+func (tc *traceCounter) node(height int, cached bool) {
+	if cached {
+		tc.cacheHits.Add(1)
+	}
+	for h := tc.minHeight.Load(); int64(height) < h; h = tc.minHeight.Load() {
+		if tc.minHeight.CompareAndSwap(h, int64(height)) {
+			return
+		}
+	}
+}
+
+// traceNode notes the use of a node at the given height with the traceCounter
+// of bs, where it has one.
+func traceNode(bs cbor.IpldStore, height int, cached bool) {
+	if s, ok := bs.(*amtStore); ok && s.trace != nil {
+		s.trace.node(height, cached)
+	}
+}
+
+// span is a started Span along with the counts at its start.
+type span struct {
+	Span
+	tc                      *traceCounter
+	nodesLoaded, cacheHits  uint64
+	bytesRead, bytesWritten uint64
+	minHeight, topHeight    int64
+}
+
+// startSpan starts a span for op with t, counting the work done with tc.
+func startSpan(ctx context.Context, t Tracer, tc *traceCounter, op string) (context.Context, *span) {
+	ctx, sp := t.Start(ctx, op)
+	return ctx, &span{
+		Span:         sp,
+		tc:           tc,
+		nodesLoaded:  tc.nodesLoaded.Load(),
+		cacheHits:    tc.cacheHits.Load(),
+		bytesRead:    tc.bytesRead.Load(),
+		bytesWritten: tc.bytesWritten.Load(),
+		minHeight:    tc.minHeight.Swap(math.MaxInt64),
+		topHeight:    tc.topHeight.Swap(-1),
+	}
+}
+
+// end ends the span, restoring the heights tracked by any enclosing span.
+func (s *span) end(err error) {
+	tc := s.tc
+	stats := SpanStats{
+		NodesLoaded:  tc.nodesLoaded.Load() - s.nodesLoaded,
+		CacheHits:    tc.cacheHits.Load() - s.cacheHits,
+		BytesRead:    tc.bytesRead.Load() - s.bytesRead,
+		BytesWritten: tc.bytesWritten.Load() - s.bytesWritten,
+	}
+	minHeight, topHeight := tc.minHeight.Load(), tc.topHeight.Load()
+	if minHeight <= topHeight {
+		stats.MaxDepth = int(topHeight - minHeight)
+	}
+	tc.minHeight.Store(min(minHeight, s.minHeight))
+	tc.topHeight.Store(max(topHeight, s.topHeight))
+	s.End(stats, err)
+}
+
+// startSpan starts a span for op where the AMT has a Tracer, returning nil
+// otherwise.
+func (r *Root) startSpan(ctx context.Context, op string) (context.Context, *span) {
+	if r.tracer == nil {
+		return ctx, nil
+	}
+	ctx, sp := startSpan(ctx, r.tracer, r.trace, op)
+	r.trace.root(r.height)
+	return ctx, sp
+}
+
+// endSpan ends a span started by startSpan, if any.
+func (r *Root) endSpan(sp *span, err error) {
+	if sp == nil {
+		return
+	}
+	r.trace.root(r.height)
+	sp.end(err)
+}
+
+// startDiffSpan starts a span for the diff operation op where opts install a
+// Tracer, returning nil otherwise. The returned options count the work done on
+// both sides of the diff for the span.
+func startDiffSpan(ctx context.Context, op string, opts []Option) (context.Context, *span, []Option, error) {
+	cfg := defaultConfig()
+	for _, opt := range opts {
+		if err := opt(cfg); err != nil {
+			return ctx, nil, nil, err
+		}
+	}
+	if cfg.tracer == nil {
+		return ctx, nil, opts, nil
+	}
+	tc := newTraceCounter()
+	ctx, sp := startSpan(ctx, cfg.tracer, tc, op)
+	return ctx, sp, append(opts[:len(opts):len(opts)], withTraceCounter(tc)), nil
+}
@@ -0,0 +1,150 @@
+package amt
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/stretchr/testify/require"
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+type testSpan struct {
+	tr    *testTracer
+	op    string
+	stats SpanStats
+	err   error
+}
+
+func (s *testSpan) End(stats SpanStats, err error) {
+	s.stats, s.err = stats, err
+	s.tr.lk.Lock()
+	defer s.tr.lk.Unlock()
+	s.tr.ended = append(s.tr.ended, s)
+}
+
+// testTracer records spans in the order they end.
+type testTracer struct {
+	lk    sync.Mutex
+	ended []*testSpan
+}
+
+func (tr *testTracer) Start(ctx context.Context, op string) (context.Context, Span) {
+	return ctx, &testSpan{tr: tr, op: op}
+}
+
+// last returns the last span to end, checking it's for op.
+func (tr *testTracer) last(t *testing.T, op string) *testSpan {
+	t.Helper()
+	tr.lk.Lock()
+	defer tr.lk.Unlock()
+	require.NotEmpty(t, tr.ended)
+	sp := tr.ended[len(tr.ended)-1]
+	require.Equal(t, op, sp.op)
+	return sp
+}
+
+func TestTracer(t *testing.T) {
+	ctx := context.Background()
+	bs := cbor.NewCborStore(newMockBlocks())
+	var tr testTracer
+	opts := []Option{UseTreeBitWidth(2), UseTracer(&tr)}
+
+	a, err := NewAMT(bs, opts...)
+	require.NoError(t, err)
+	for i := uint64(0); i < 64; i++ {
+		assertSet(t, a, i, "foo")
+	}
+	require.Equal(t, 2, a.height)
+	sp := tr.last(t, "Set")
+	require.NoError(t, sp.err)
+	require.Zero(t, sp.stats.NodesLoaded)
+	require.Equal(t, 2, sp.stats.MaxDepth)
+
+	root, err := a.Flush(ctx)
+	require.NoError(t, err)
+	var nodes, stored, rootSize int
+	require.NoError(t, WalkNodes(ctx, bs, root, func(info NodeInfo) error {
+		if nodes == 0 {
+			rootSize = info.Size
+		}
+		nodes++
+		stored += info.Size
+		return nil
+	}, opts...))
+	sp = tr.last(t, "Flush")
+	require.Zero(t, sp.stats.NodesLoaded)
+	require.Equal(t, uint64(stored), sp.stats.BytesWritten)
+
+	a, err = LoadAMT(ctx, bs, root, opts...)
+	require.NoError(t, err)
+	found, err := a.Get(ctx, 63, nil)
+	require.NoError(t, err)
+	require.True(t, found)
+	sp = tr.last(t, "Get")
+	require.Equal(t, SpanStats{NodesLoaded: 2, BytesRead: sp.stats.BytesRead, MaxDepth: 2}, sp.stats)
+	require.NotZero(t, sp.stats.BytesRead)
+	getBytes := sp.stats.BytesRead
+
+	_, err = a.Get(ctx, 63, nil)
+	require.NoError(t, err)
+	sp = tr.last(t, "Get")
+	require.Equal(t, SpanStats{CacheHits: 2, MaxDepth: 2}, sp.stats)
+
+	// a Get from within ForEach is included in the ForEach span
+	require.NoError(t, a.ForEach(ctx, func(i uint64, _ *cbg.Deferred) error {
+		if i == 0 {
+			_, err := a.Get(ctx, 1, nil)
+			return err
+		}
+		return nil
+	}))
+	sp = tr.last(t, "ForEach")
+	require.Equal(t, uint64(nodes-1-2), sp.stats.NodesLoaded)
+	require.Equal(t, uint64(stored-rootSize), sp.stats.BytesRead+getBytes)
+	require.Equal(t, 2, sp.stats.MaxDepth)
+	inner := tr.ended[len(tr.ended)-2]
+	require.Equal(t, "Get", inner.op)
+	require.Equal(t, SpanStats{CacheHits: 2, MaxDepth: 2}, inner.stats)
+
+	found, err = a.Delete(ctx, 63)
+	require.NoError(t, err)
+	require.True(t, found)
+	sp = tr.last(t, "Delete")
+	require.Equal(t, 2, sp.stats.MaxDepth)
+
+	_, err = a.Get(ctx, MaxIndex+1, nil)
+	require.Error(t, err)
+	require.Equal(t, err, tr.last(t, "Get").err)
+
+	changed, err := a.Flush(ctx)
+	require.NoError(t, err)
+
+	_, err = Diff(ctx, bs, bs, root, changed, opts...)
+	require.NoError(t, err)
+	sp = tr.last(t, "Diff")
+	require.Equal(t, 2, sp.stats.MaxDepth)
+	require.Equal(t, uint64(2+2*2), sp.stats.NodesLoaded)
+
+	_, err = ParallelDiff(ctx, bs, bs, root, changed, 4, opts...)
+	require.NoError(t, err)
+	sp = tr.last(t, "ParallelDiff")
+	require.Equal(t, 2, sp.stats.MaxDepth)
+	require.Equal(t, uint64(2+2*2), sp.stats.NodesLoaded)
+}
+
+func TestNoTracer(t *testing.T) {
+	ctx := context.Background()
+	bs := cbor.NewCborStore(newMockBlocks())
+	a, err := NewAMT(bs)
+	require.NoError(t, err)
+	require.Equal(t, bs, a.store)
+	assertSet(t, a, 1000, "foo")
+	c, err := a.Flush(ctx)
+	require.NoError(t, err)
+
+	a, err = LoadAMT(ctx, bs, c)
+	require.NoError(t, err)
+	require.Equal(t, bs, a.store)
+}
@@ -2,9 +2,14 @@ package amt
 
 import (
 	"bytes"
+	"context"
+	"fmt"
+	"io"
 	"math"
 	"sync"
 
+	cid "github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
 	cbg "github.com/whyrusleeping/cbor-gen"
 )
 
@@ -45,3 +50,51 @@ func cborToBytes(val cbg.CBORMarshaler) ([]byte, error) {
 
 	return cpy, nil
 }
+
+// rawBlock is a serialized block that is passed through an IpldStore
+// unchanged, so blocks can be read and written without being re-encoded.
+type rawBlock struct {
+	cid  cid.Cid
+	data []byte
+}
+
+// Cid tells the IpldStore which CID the block must be stored under.
+func (b *rawBlock) Cid() cid.Cid {
+	return b.cid
+}
+
+func (b *rawBlock) MarshalCBOR(w io.Writer) error {
+	_, err := w.Write(b.data)
+	return err
+}
+
+func (b *rawBlock) UnmarshalCBOR(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	b.data = data
+	return nil
+}
+
+// getRawBlock reads the serialized block c from bs.
+func getRawBlock(ctx context.Context, bs cbor.IpldStore, c cid.Cid) (*rawBlock, error) {
+	b := &rawBlock{cid: c}
+	if err := bs.Get(ctx, c, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// putRawBlock writes a serialized block to bs, which must store it under the
+// block's own CID.
+func putRawBlock(ctx context.Context, bs cbor.IpldStore, b *rawBlock) error {
+	c, err := bs.Put(ctx, b)
+	if err != nil {
+		return err
+	}
+	if !c.Equals(b.cid) {
+		return fmt.Errorf("block %s was stored as %s", b.cid, c)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package amt
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	cbg "github.com/whyrusleeping/cbor-gen"
+	"golang.org/x/xerrors"
+)
+
+// NodeInfo describes a single block of an AMT, as visited by WalkNodes.
+type NodeInfo struct {
+	// Cid is the CID of the block. For the root block, which holds the
+	// top-most node, this is the AMT's root CID.
+	Cid cid.Cid
+	// Height is the height of the node, 0 for leaves.
+	Height int
+	// Offset is the first index covered by the node, and Span the number of
+	// indexes it covers, so the node covers [Offset, Offset+Span). Span
+	// saturates at math.MaxUint64 for nodes covering the whole index space.
+	Offset uint64
+	Span   uint64
+	// Slots is the number of links, or values for leaves, set in the node.
+	Slots int
+	// Size is the encoded size of the block in bytes.
+	Size int
+}
+
+// WalkNodes calls cb with every block of the AMT at root: the root block
+// first, followed by every node in depth-first order, following links in
+// ascending position. Nothing is cached, so the AMT can be larger than
+// memory.
+func WalkNodes(ctx context.Context, bs cbor.IpldStore, root cid.Cid, cb func(NodeInfo) error, opts ...Option) error {
+	cfg := defaultConfig()
+	for _, opt := range opts {
+		if err := opt(cfg); err != nil {
+			return err
+		}
+	}
+	return walkRawBlocks(ctx, bs, root, cfg, func(b *rawBlock, height int, offset uint64, n *node) error {
+		return cb(NodeInfo{
+			Cid:    b.cid,
+			Height: height,
+			Offset: offset,
+			Span:   nodesForHeight(cfg.bitWidth, height+1),
+			Slots:  n.slots(),
+			Size:   len(b.data),
+		})
+	})
+}
+
+// slots returns the number of links or values set in the node.
+func (n *node) slots() int {
+	count := 0
+	for _, ln := range n.links {
+		if ln != nil {
+			count++
+		}
+	}
+	for _, v := range n.values {
+		if v != nil {
+			count++
+		}
+	}
+	return count
+}
+
+// AllCIDs flushes the AMT and returns the CIDs of all of its blocks, in the
+// order WalkNodes first visits them. If values is true, the CIDs linked from
+// within values follow, in index order, without being followed themselves.
+// Each CID is listed once, however many times it's linked, as identical
+// subtrees share a block.
+func (r *Root) AllCIDs(ctx context.Context, values bool) ([]cid.Cid, error) {
+	c, err := r.Flush(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var cids, linked []cid.Cid
+	seen := make(map[cid.Cid]struct{})
+	add := func(list *[]cid.Cid, c cid.Cid) {
+		if _, ok := seen[c]; !ok {
+			seen[c] = struct{}{}
+			*list = append(*list, c)
+		}
+	}
+	// Any limits the AMT was loaded with are applied by r.store.
+	cfg := defaultConfig()
+	cfg.bitWidth = r.bitWidth
+	err = walkRawBlocks(ctx, r.store, c, cfg, func(b *rawBlock, height int, offset uint64, n *node) error {
+		add(&cids, b.cid)
+		if !values || height > 0 {
+			return nil
+		}
+		for i, v := range n.values {
+			if v == nil {
+				continue
+			}
+			if err := cbg.ScanForLinks(bytes.NewReader(v.Raw), func(c cid.Cid) {
+				add(&linked, c)
+			}); err != nil {
+				return xerrors.Errorf("scanning value at index %d for links: %w", offset+uint64(i), err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(cids, linked...), nil
+}
@@ -0,0 +1,114 @@
+package amt
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/stretchr/testify/require"
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+func TestWalkNodes(t *testing.T) {
+	runTestWithBitWidths(t, bitWidths2to18, func(t *testing.T, opts ...Option) {
+		ctx := context.Background()
+		bs := cbor.NewCborStore(newMockBlocks())
+
+		a, err := NewAMT(bs, opts...)
+		require.NoError(t, err)
+		for i := uint64(0); i < 300; i += 3 {
+			assertSet(t, a, i, "value")
+		}
+		assertSet(t, a, 1<<30, "far")
+		c, err := a.Flush(ctx)
+		require.NoError(t, err)
+
+		// copying into a fresh store leaves exactly the AMT's blocks
+		fresh := newCheckingStore()
+		_, err = Copy(ctx, bs, fresh, c, opts...)
+		require.NoError(t, err)
+
+		var infos []NodeInfo
+		require.NoError(t, WalkNodes(ctx, bs, c, func(info NodeInfo) error {
+			infos = append(infos, info)
+			return nil
+		}, opts...))
+		require.Equal(t, c, infos[0].Cid)
+		require.Equal(t, a.height, infos[0].Height)
+		require.Equal(t, uint64(0), infos[0].Offset)
+
+		values := 0
+		for _, info := range infos {
+			require.Contains(t, fresh.mock.data, info.Cid)
+			require.Len(t, fresh.mock.data[info.Cid].RawData(), info.Size)
+			require.NotZero(t, info.Slots)
+			if info.Height == 0 {
+				values += info.Slots
+				require.Equal(t, nodesForHeight(a.bitWidth, 1), info.Span)
+			}
+		}
+		require.Equal(t, 101, values)
+
+		// every block is visited
+		visited := make(map[cid.Cid]bool)
+		for _, info := range infos {
+			visited[info.Cid] = true
+		}
+		require.Len(t, visited, len(fresh.mock.data))
+	})
+}
+
+func TestAllCIDs(t *testing.T) {
+	ctx := context.Background()
+	bs := cbor.NewCborStore(newMockBlocks())
+
+	target, err := bs.Put(ctx, cborstr("target"))
+	require.NoError(t, err)
+
+	a, err := NewAMT(bs)
+	require.NoError(t, err)
+	for i := uint64(0); i < 100; i++ {
+		assertSet(t, a, i, "value")
+	}
+	link := cbg.CborCid(target)
+	require.NoError(t, a.Set(ctx, 5000, &link))
+
+	nodes, err := a.AllCIDs(ctx, false)
+	require.NoError(t, err)
+	require.NotContains(t, nodes, target)
+
+	all, err := a.AllCIDs(ctx, true)
+	require.NoError(t, err)
+	require.Equal(t, append(nodes, target), all)
+
+	c, err := a.Flush(ctx)
+	require.NoError(t, err)
+	require.Equal(t, c, nodes[0])
+}
+
+func TestAllCIDsSharedSubtrees(t *testing.T) {
+	ctx := context.Background()
+	bs := cbor.NewCborStore(newMockBlocks())
+
+	// every leaf holds the same values, so they're all the same block
+	a, err := NewAMT(bs, UseTreeBitWidth(2))
+	require.NoError(t, err)
+	for i := uint64(0); i < 8; i++ {
+		assertSet(t, a, i, "x")
+	}
+	c, err := a.Flush(ctx)
+	require.NoError(t, err)
+
+	var walked []cid.Cid
+	require.NoError(t, WalkNodes(ctx, bs, c, func(info NodeInfo) error {
+		walked = append(walked, info.Cid)
+		return nil
+	}, UseTreeBitWidth(2)))
+	require.Len(t, walked, 3)
+	require.Equal(t, walked[1], walked[2])
+
+	all, err := a.AllCIDs(ctx, true)
+	require.NoError(t, err)
+	require.Equal(t, walked[:2], all)
+}